@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 
+	plog "github.com/adityavit/proglog/internal/log"
 	"github.com/adityavit/proglog/internal/server"
 )
 
@@ -14,15 +15,41 @@ func main() {
 	//take logDir from arguments
 	logDir := flag.String("logDir", "/tmp/proglog", "directory to store log files")
 	addr := flag.String("addr", ":8080", "address to listen on")
+	logConfig := plog.Config{}
+	flag.Uint64Var(&logConfig.Segment.MaxRecordBytes, "maxRecordBytes", 0, "largest record that can be produced, 0 allows any that fits in a segment but limits records produced over HTTP to 1MiB")
+	flag.Uint64Var(&logConfig.Index.IntervalRecords, "indexIntervalRecords", 0, "records between sparse index entries, 0 with indexIntervalBytes indexes every record")
+	flag.Uint64Var(&logConfig.Index.IntervalBytes, "indexIntervalBytes", 0, "bytes of store between sparse index entries")
+	flag.TextVar(&logConfig.Durability.Sync, "sync", plog.SyncOS, "when to sync appended records to disk: os, append or periodic")
+	flag.Uint64Var(&logConfig.Durability.SyncRecords, "syncRecords", 0, "number of records after which a periodic sync happens")
+	flag.DurationVar(&logConfig.Durability.SyncInterval, "syncInterval", 0, "interval between periodic syncs")
+	flag.Uint64Var(&logConfig.Retention.MaxBytes, "retentionBytes", 0, "size of the log above which the oldest segments are removed")
+	flag.DurationVar(&logConfig.Retention.MaxAge, "retentionAge", 0, "how long segments are kept after their newest record")
+	flag.IntVar(&logConfig.Retention.MinSegments, "retentionMinSegments", 1, "number of segments that are always kept")
+	flag.BoolVar(&logConfig.Compaction.Enabled, "compaction", false, "keep only the newest record of every key in sealed segments")
+	flag.DurationVar(&logConfig.Compaction.DeleteRetention, "deleteRetention", 0, "how long tombstones are kept by compaction")
+	flag.Func("compression", "codec to compress records with: none, gzip or flate", func(name string) (err error) {
+		logConfig.Compression.Codec, err = plog.CodecByName(name)
+		return err
+	})
+	flag.BoolVar(&logConfig.Compression.PerBatch, "compressPerBatch", false, "compress records appended together as a whole")
+	flag.Func("encryptionKeys", "JSON file with the keys to encrypt records with", func(path string) error {
+		keys, err := plog.NewFileKeyProvider(path)
+		logConfig.Encryption.Keys = keys
+		return err
+	})
+	flag.BoolVar(&logConfig.ReadOnly.Enabled, "readOnly", false, "serve reads of a log another process writes, produce requests are refused")
+	flag.DurationVar(&logConfig.ReadOnly.RefreshInterval, "refreshInterval", 0, "how often a read-only log picks up appended records")
+	flag.BoolVar(&logConfig.Timestamps.UseProducerTime, "producerTimestamps", false, "keep the timestamps set by producers instead of the append time")
 	flag.Parse()
 	fmt.Printf("logDir: %s, addr: %s\n", *logDir, *addr)
-	//create log directory
-	err := os.MkdirAll(*logDir, 0o755)
-	if err != nil {
-		log.Fatal(err)
+	//create log directory, a read-only log has to exist already
+	if !logConfig.ReadOnly.Enabled {
+		if err := os.MkdirAll(*logDir, 0o755); err != nil {
+			log.Fatal(err)
+		}
 	}
 	//create a new http server
-	server, err := server.NewHTTPServer(*logDir, *addr)
+	server, err := server.NewHTTPServer(*logDir, *addr, logConfig)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,86 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// startOffsetFile checkpoints the offset a log starts at after Truncate, the
+// records below it may still be in the first segment
+const startOffsetFile = "log-start-offset"
+
+// readStartOffset returns the checkpointed start offset of the log in dir, 0
+// when there is none
+func readStartOffset(dir string) (uint64, error) {
+	b, err := os.ReadFile(filepath.Join(dir, startOffsetFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	off, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parsing %s: %w", startOffsetFile, err)
+	}
+	return off, nil
+}
+
+// writeStartOffset checkpoints the start offset of the log in dir, the file
+// is replaced atomically so a crash leaves either the old or the new offset
+func writeStartOffset(dir string, off uint64) error {
+	path := filepath.Join(dir, startOffsetFile)
+	tmp := path + ".tmp"
+	if err := writeFileSync(tmp, []byte(strconv.FormatUint(off, 10)+"\n")); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// writeFileSync writes the file and syncs it to disk
+func writeFileSync(name string, data []byte) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir makes a rename in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// lowestOffset returns the offset of the first record that can be read, the
+// caller must hold the lock
+func (l *Log) lowestOffset() uint64 {
+	return max(l.startOffset, l.segments[0].baseOffset)
+}
+
+// checkLowest returns an ErrOffsetTruncated when the offset is below the
+// start of the log, the caller must hold the lock
+func (l *Log) checkLowest(offset uint64) error {
+	if lowest := l.lowestOffset(); offset < lowest {
+		return &ErrOffsetTruncated{Offset: offset, Start: lowest}
+	}
+	return nil
+}
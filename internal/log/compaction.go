@@ -0,0 +1,201 @@
+package log
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"time"
+
+	v1 "github.com/adityavit/proglog/api/v1"
+)
+
+const (
+	defaultCompactionCheckInterval = 5 * time.Minute
+	defaultDeleteRetention         = 24 * time.Hour
+	// cleanedExt is the extension of a compacted store that hasn't been
+	// swapped in yet
+	cleanedExt = ".cleaned"
+)
+
+// startCompaction starts compacting the log in the background, it returns nil
+// when compaction isn't enabled
+func startCompaction(l *Log) *loop {
+	c := l.Config.Compaction
+	if !c.Enabled {
+		return nil
+	}
+	return startLoop(c.CheckInterval, func() {
+		if err := l.Compact(); err != nil {
+			slog.Error("compacting log failed", "dir", l.Dir, "error", err)
+		}
+	})
+}
+
+// Compact rewrites the sealed segments keeping only the newest record for
+// every key. Records without a key are always kept and a tombstone, a keyed
+// record with an empty value, is dropped once it's older than
+// Compaction.DeleteRetention. Records keep their offsets, so a compacted log
+// has gaps in them. The active segment is never compacted and neither are the
+// keys in it taken into account.
+func (l *Log) Compact() error {
+	if err := l.checkWritable(); err != nil {
+		return err
+	}
+	l.compactMu.Lock()
+	defer l.compactMu.Unlock()
+	l.mu.RLock()
+	sealed := slices.Clone(l.segments[:len(l.segments)-1])
+	truncations := l.truncations
+	l.mu.RUnlock()
+
+	latest := make(map[string]uint64)
+	for _, s := range sealed {
+		err := l.scanSegment(s, func(record *v1.Record, _ []byte) {
+			if len(record.Key) > 0 {
+				latest[string(record.Key)] = record.Offset
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("scanning segment %d: %w", s.baseOffset, err)
+		}
+	}
+
+	deleteBefore := time.Now().Add(-l.Config.Compaction.DeleteRetention).UnixMilli()
+	for _, s := range sealed {
+		keep := func(record *v1.Record) bool {
+			if len(record.Key) == 0 {
+				return true
+			}
+			if latest[string(record.Key)] != record.Offset {
+				return false
+			}
+			return len(record.Value) > 0 || record.Timestamp >= deleteBefore
+		}
+		if err := l.compactSegment(s, keep, truncations); err != nil {
+			return fmt.Errorf("compacting segment %d: %w", s.baseOffset, err)
+		}
+	}
+	return nil
+}
+
+// scanSegment calls fn with every record in the segment and its payload. A
+// segment that has been removed from the log in the meantime is skipped.
+func (l *Log) scanSegment(s *Segment, fn func(record *v1.Record, payload []byte)) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if !slices.Contains(l.segments, s) {
+		return nil
+	}
+	for pos := uint64(0); pos < s.store.size; {
+		records, payloads, f, err := s.readRecordsAt(pos)
+		if err != nil {
+			return err
+		}
+		for i, record := range records {
+			fn(record, payloads[i])
+		}
+		pos += f.width
+	}
+	return nil
+}
+
+// compactSegment writes the records of the segment to keep into a new store
+// and swaps it in for the old one. The indexes are rebuilt from the new store,
+// which also happens when the process dies half way through the swap. The new
+// store is thrown away when the log was truncated since the compaction
+// started: the segment may be the active one again and the newest records of
+// the keys may be gone.
+func (l *Log) compactSegment(s *Segment, keep func(*v1.Record) bool, truncations uint64) error {
+	var kept [][]byte
+	dropped := 0
+	err := l.scanSegment(s, func(record *v1.Record, payload []byte) {
+		if keep(record) {
+			kept = append(kept, payload)
+		} else {
+			dropped++
+		}
+	})
+	if err != nil || dropped == 0 {
+		return err
+	}
+
+	cleaned := s.store.Name() + cleanedExt
+	if err := writeStore(cleaned, kept, l.Config); err != nil {
+		os.Remove(cleaned)
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	i := slices.Index(l.segments, s)
+	if i < 0 || l.truncations != truncations {
+		return os.Remove(cleaned)
+	}
+	if err := s.Close(); err != nil {
+		return err
+	}
+	// The indexes go first so that whichever store survives a crash gets
+	// them rebuilt
+	if err := os.Remove(s.index.Name()); err != nil {
+		return err
+	}
+	if err := os.Remove(s.timeIndex.Name()); err != nil {
+		return err
+	}
+	if err := os.Rename(cleaned, s.store.Name()); err != nil {
+		return err
+	}
+	slog.Info("compacted segment",
+		"dir", l.Dir,
+		"segment", s.baseOffset,
+		"keptRecords", len(kept),
+		"droppedRecords", dropped,
+	)
+	// The first segment stays around even when empty so that the lowest
+	// offset of the log doesn't move
+	if len(kept) == 0 && i > 0 {
+		l.segments = slices.Delete(l.segments, i, i+1)
+		return os.Remove(s.store.Name())
+	}
+	compacted, err := NewSegment(l.Dir, s.baseOffset, l.Config)
+	if err != nil {
+		return err
+	}
+	if err := compacted.Seal(); err != nil {
+		return err
+	}
+	l.segments[i] = compacted
+	return nil
+}
+
+// writeStore writes the payloads to a new store file and syncs it. They are
+// compressed one by one, so that reading a record doesn't mean decompressing
+// a whole compacted batch.
+func writeStore(name string, payloads [][]byte, c Config) error {
+	c.Compression.PerBatch = false
+	frames, flags, err := encodePayloads(c, payloads)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	st, err := newStore(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if len(frames) > 0 {
+		if _, _, err := st.AppendBatch(frames, flags, false); err != nil {
+			st.Close()
+			return err
+		}
+	}
+	if err := st.Sync(); err != nil {
+		st.Close()
+		return err
+	}
+	return st.Close()
+}
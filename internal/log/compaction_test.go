@@ -0,0 +1,215 @@
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	v1 "github.com/adityavit/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompact(t *testing.T) {
+	dir, err := os.MkdirTemp("", "compaction-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := Config{}
+	// Every record fills up a segment of its own
+	config.Segment.MaxIndexBytes = entryWidth
+	config.Timestamps.UseProducerTime = true
+	config.Compaction.DeleteRetention = time.Hour
+	log, err := NewLog(dir, config)
+	require.NoError(t, err)
+
+	old := time.Now().Add(-2 * time.Hour).UnixMilli()
+	for _, record := range []*v1.Record{
+		{Key: []byte("k1"), Value: []byte("a")},
+		{Key: []byte("k2"), Value: []byte("a")},
+		{Key: []byte("k1"), Value: []byte("b")},
+		{Value: []byte("no key")},
+		// A tombstone past the delete retention takes its key with it
+		{Key: []byte("k2"), Timestamp: old},
+		{Key: []byte("k3")},
+		{Key: []byte("k1"), Value: []byte("c")},
+	} {
+		_, err := log.Append(record)
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Compact())
+
+	readAll := func() []uint64 {
+		var offsets []uint64
+		for off := uint64(0); ; off++ {
+			record, err := log.Read(off)
+			if err != nil {
+				return offsets
+			}
+			offsets = append(offsets, record.Offset)
+			off = record.Offset
+		}
+	}
+	require.Equal(t, []uint64{3, 5, 6}, readAll())
+	// Reading a compacted offset gets the next record after it
+	read, err := log.Read(4)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), read.Offset)
+	require.Equal(t, []byte("k3"), read.Key)
+	off, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), off)
+
+	// Compacting again changes nothing
+	require.NoError(t, log.Compact())
+	require.Equal(t, []uint64{3, 5, 6}, readAll())
+
+	// A compacted store that wasn't swapped in is thrown away on restart
+	require.NoError(t, log.Close())
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "3.store"+cleanedExt), []byte("partial"), 0644))
+	log, err = NewLog(dir, config)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Equal(t, []uint64{3, 5, 6}, readAll())
+	_, err = os.Stat(filepath.Join(dir, "3.store"+cleanedExt))
+	require.ErrorIs(t, err, os.ErrNotExist)
+	read, err = log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("no key"), read.Value)
+}
+
+func TestCompactionLoop(t *testing.T) {
+	dir, err := os.MkdirTemp("", "compaction-loop-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := Config{}
+	config.Segment.MaxIndexBytes = entryWidth
+	config.Compaction.Enabled = true
+	config.Compaction.CheckInterval = time.Millisecond
+	log, err := NewLog(dir, config)
+	require.NoError(t, err)
+	defer log.Close()
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&v1.Record{Key: []byte("key"), Value: []byte("value")})
+		require.NoError(t, err)
+	}
+
+	// The older records are dropped, the first segment stays around empty
+	require.Eventually(t, func() bool {
+		log.mu.RLock()
+		defer log.mu.RUnlock()
+		return len(log.segments) == 3 && log.segments[1].baseOffset == 2
+	}, time.Second, time.Millisecond)
+	require.Equal(t, log.segments[0].baseOffset, log.segments[0].nextOffset)
+	read, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), read.Offset)
+}
+
+// hookCodec is gzip calling a hook before compressing, its frames are read
+// back as gzip ones
+type hookCodec struct {
+	gzipCodec
+	hook func()
+}
+
+func (c *hookCodec) Compress(p []byte) ([]byte, error) {
+	if c.hook != nil {
+		c.hook()
+	}
+	return c.gzipCodec.Compress(p)
+}
+
+func TestCompactDuringTruncateAfter(t *testing.T) {
+	dir, err := os.MkdirTemp("", "compaction-truncate-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	codec := &hookCodec{}
+	config := Config{}
+	config.Segment.MaxIndexBytes = 2 * entryWidth
+	config.Compression.Codec = codec
+	log, err := NewLog(dir, config)
+	require.NoError(t, err)
+	defer log.Close()
+
+	for _, record := range []*v1.Record{
+		{Key: []byte("k1"), Value: []byte("a")},
+		{Value: []byte("no key")},
+		{Key: []byte("k1"), Value: []byte("b")},
+		{Key: []byte("k2"), Value: []byte("a")},
+		{Key: []byte("k3"), Value: []byte("a")},
+	} {
+		_, err := log.Append(record)
+		require.NoError(t, err)
+	}
+	require.Len(t, log.segments, 3)
+
+	// The log is truncated back into the first segment while its compacted
+	// store is being written, which drops the newest record of k1
+	var once sync.Once
+	codec.hook = func() {
+		once.Do(func() { require.NoError(t, log.TruncateAfter(1)) })
+	}
+	require.NoError(t, log.Compact())
+	codec.hook = nil
+
+	require.Len(t, log.segments, 1)
+	require.Same(t, log.segments[0], log.activeSegment)
+	read, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), read.Value)
+	_, err = os.Stat(filepath.Join(dir, "0.store"+cleanedExt))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	off, err := log.Append(&v1.Record{Key: []byte("k1"), Value: []byte("c")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	read, err = log.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, []byte("c"), read.Value)
+}
+
+func TestTruncateAfterCompacted(t *testing.T) {
+	dir, err := os.MkdirTemp("", "compaction-truncate-after-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := Config{}
+	config.Segment.MaxIndexBytes = 3 * entryWidth
+	log, err := NewLog(dir, config)
+	require.NoError(t, err)
+	for _, key := range []string{"a", "b", "b", "c", "b", "d", "e"} {
+		_, err := log.Append(&v1.Record{Key: []byte(key), Value: []byte("value")})
+		require.NoError(t, err)
+	}
+	// Only the record of a is left in the first segment
+	require.NoError(t, log.Compact())
+
+	// Offsets 1 and 2 were handed out before, they aren't handed out again
+	require.NoError(t, log.TruncateAfter(2))
+	off, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	_, err = log.Read(1)
+	require.ErrorIs(t, err, ErrOffsetOutOfRange)
+
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, config)
+	require.NoError(t, err)
+	defer log.Close()
+	off, err = log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	off, err = log.Append(&v1.Record{Key: []byte("f"), Value: []byte("value")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	read, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), read.Key)
+	read, err = log.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), read.Offset)
+}
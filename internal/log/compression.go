@@ -0,0 +1,213 @@
+package log
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Codec compresses the payload of frames. Its ID is stored in the flags of
+// every frame it compressed, so a store can mix frames of different codecs
+// and uncompressed ones.
+type Codec interface {
+	// ID identifies the codec in the frame flags, it must be between 1 and
+	// maxCodecID
+	ID() byte
+	Name() string
+	Compress(p []byte) ([]byte, error)
+	Decompress(p []byte) ([]byte, error)
+}
+
+const (
+	// The codec ID takes bits 2 to 4 of the frame flags
+	frameCodecShift      = 2
+	frameCodecMask  byte = 0x7 << frameCodecShift
+	maxCodecID           = 0x7
+)
+
+var (
+	// Gzip compresses frames with gzip
+	Gzip Codec = gzipCodec{}
+	// Flate compresses frames with raw deflate, which is gzip without the
+	// header and the checksum
+	Flate Codec = flateCodec{}
+
+	codecsMu sync.RWMutex
+	codecs   = map[byte]Codec{}
+)
+
+func init() {
+	RegisterCodec(Gzip)
+	RegisterCodec(Flate)
+}
+
+// RegisterCodec makes a codec available to read frames it compressed, a codec
+// has to be registered before a log holding such frames is opened
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	if c.ID() == 0 || c.ID() > maxCodecID {
+		panic(fmt.Sprintf("log: codec %s has ID %d outside of 1-%d", c.Name(), c.ID(), maxCodecID))
+	}
+	if _, ok := codecs[c.ID()]; ok {
+		panic(fmt.Sprintf("log: codec ID %d registered twice", c.ID()))
+	}
+	codecs[c.ID()] = c
+}
+
+// CodecByName returns the registered codec with the name, "none" and the
+// empty name return a nil codec
+func CodecByName(name string) (Codec, error) {
+	if name == "" || name == "none" {
+		return nil, nil
+	}
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	for _, c := range codecs {
+		if c.Name() == name {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown codec %q", name)
+}
+
+func codecByID(id byte) (Codec, bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	c, ok := codecs[id]
+	return c, ok
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) ID() byte     { return 1 }
+func (gzipCodec) Name() string { return "gzip" }
+
+func (gzipCodec) Compress(p []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(p); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) Decompress(p []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(p))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+type flateCodec struct{}
+
+func (flateCodec) ID() byte     { return 2 }
+func (flateCodec) Name() string { return "flate" }
+
+func (flateCodec) Compress(p []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(p); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (flateCodec) Decompress(p []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(p))
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// encodePayloads turns the marshaled records into the payloads of the frames
+// to write and the flags shared by all of them. With PerBatch set the records
+// go into a single frame, each of them prefixed with its length as a uvarint.
+// The frames are then encrypted when the log has a KeyProvider.
+func encodePayloads(c Config, payloads [][]byte) ([][]byte, byte, error) {
+	payloads, flags, err := compress(c, payloads)
+	if err != nil || c.Encryption.Keys == nil {
+		return payloads, flags, err
+	}
+	encrypted, err := encrypt(c.Encryption.Keys, payloads)
+	if err != nil {
+		return nil, 0, fmt.Errorf("encrypting: %w", err)
+	}
+	return encrypted, flags | frameFlagEncrypted, nil
+}
+
+func compress(c Config, payloads [][]byte) ([][]byte, byte, error) {
+	codec := c.Compression.Codec
+	if codec == nil {
+		return payloads, 0, nil
+	}
+	var flags byte
+	if c.Compression.PerBatch && len(payloads) > 1 {
+		var batch []byte
+		for _, p := range payloads {
+			batch = binary.AppendUvarint(batch, uint64(len(p)))
+			batch = append(batch, p...)
+		}
+		payloads = [][]byte{batch}
+		flags |= frameFlagBatch
+	}
+	encoded := make([][]byte, len(payloads))
+	for i, p := range payloads {
+		compressed, err := codec.Compress(p)
+		if err != nil {
+			return nil, 0, fmt.Errorf("compressing with %s: %w", codec.Name(), err)
+		}
+		encoded[i] = compressed
+	}
+	return encoded, flags | codec.ID()<<frameCodecShift, nil
+}
+
+// records decrypts and decompresses the payload of the frame and returns the
+// marshaled records in it
+func (f *frame) records(keys KeyProvider) ([][]byte, error) {
+	p := f.payload
+	if f.flags&frameFlagEncrypted != 0 {
+		var err error
+		if p, err = decrypt(keys, p); err != nil {
+			return nil, err
+		}
+	}
+	if id := (f.flags & frameCodecMask) >> frameCodecShift; id != 0 {
+		codec, ok := codecByID(id)
+		if !ok {
+			return nil, fmt.Errorf("unknown codec ID %d", id)
+		}
+		var err error
+		if p, err = codec.Decompress(p); err != nil {
+			return nil, fmt.Errorf("decompressing with %s: %w", codec.Name(), err)
+		}
+	}
+	if f.flags&frameFlagBatch == 0 {
+		return [][]byte{p}, nil
+	}
+	var records [][]byte
+	for len(p) > 0 {
+		n, w := binary.Uvarint(p)
+		if w <= 0 || n > uint64(len(p)-w) {
+			return nil, errors.New("malformed batch")
+		}
+		records = append(records, p[w:w+int(n)])
+		p = p[w+int(n):]
+	}
+	return records, nil
+}
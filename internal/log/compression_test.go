@@ -0,0 +1,150 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	v1 "github.com/adityavit/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestCodecs(t *testing.T) {
+	p := bytes.Repeat([]byte(`{"hello": "world"}`), 100)
+	for _, name := range []string{"gzip", "flate"} {
+		codec, err := CodecByName(name)
+		require.NoError(t, err)
+		require.Equal(t, name, codec.Name())
+		compressed, err := codec.Compress(p)
+		require.NoError(t, err)
+		require.Less(t, len(compressed), len(p)/5)
+		decompressed, err := codec.Decompress(compressed)
+		require.NoError(t, err)
+		require.Equal(t, p, decompressed)
+	}
+	codec, err := CodecByName("none")
+	require.NoError(t, err)
+	require.Nil(t, codec)
+	_, err = CodecByName("lz4")
+	require.Error(t, err)
+}
+
+func TestSegmentCompression(t *testing.T) {
+	value := bytes.Repeat([]byte(`{"hello": "world"}`), 20)
+	for _, tc := range []struct {
+		codec    Codec
+		perBatch bool
+	}{
+		{codec: Gzip},
+		{codec: Flate},
+		{codec: Gzip, perBatch: true},
+		{codec: Flate, perBatch: true},
+	} {
+		t.Run(fmt.Sprintf("%s/perBatch=%t", tc.codec.Name(), tc.perBatch), func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "compression-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			config := Config{}
+			config.Segment.MaxStoreBytes = 1 << 20
+			config.Segment.MaxIndexBytes = 1024
+			s, err := NewSegment(dir, 0, config)
+			require.NoError(t, err)
+			// Uncompressed records stay readable next to compressed ones
+			_, err = s.Append(&v1.Record{Value: value})
+			require.NoError(t, err)
+			uncompressed := s.store.size
+			require.NoError(t, s.Close())
+
+			config.Compression.Codec = tc.codec
+			config.Compression.PerBatch = tc.perBatch
+			s, err = NewSegment(dir, 0, config)
+			require.NoError(t, err)
+			_, err = s.Append(&v1.Record{Value: value})
+			require.NoError(t, err)
+			batch := []*v1.Record{{Value: value}, {Value: value}, {Value: value}}
+			first, err := s.AppendBatch(batch)
+			require.NoError(t, err)
+			require.Equal(t, uint64(2), first)
+			require.Less(t, s.store.size, 2*uncompressed)
+
+			for off := uint64(0); off < 5; off++ {
+				record, err := s.Read(off)
+				require.NoError(t, err)
+				require.Equal(t, off, record.Offset)
+				require.Equal(t, value, record.Value)
+			}
+
+			// Reopening rebuilds the indexes from the compressed frames
+			require.NoError(t, s.Close())
+			require.NoError(t, os.Remove(s.index.Name()))
+			require.NoError(t, os.Remove(s.timeIndex.Name()))
+			s, err = NewSegment(dir, 0, config)
+			require.NoError(t, err)
+			defer s.Close()
+			require.Equal(t, uint64(5), s.nextOffset)
+			record, err := s.Read(3)
+			require.NoError(t, err)
+			require.Equal(t, uint64(3), record.Offset)
+		})
+	}
+}
+
+func TestSegmentRecoverBatchFrame(t *testing.T) {
+	dir, err := os.MkdirTemp("", "compression-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := Config{}
+	config.Segment.MaxStoreBytes = 1024
+	config.Segment.MaxIndexBytes = 1024
+	config.Compression.Codec = Gzip
+	config.Compression.PerBatch = true
+	s, err := NewSegment(dir, 0, config)
+	require.NoError(t, err)
+	defer s.Close()
+	_, err = s.AppendBatch([]*v1.Record{{Value: []byte("a")}, {Value: []byte("b")}, {Value: []byte("c")}})
+	require.NoError(t, err)
+	require.NoError(t, s.Flush())
+
+	// Only the first entries of the batch frame made it into the index
+	s.index.truncate(1)
+	_, err = s.recover(true)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), s.nextOffset)
+	require.Equal(t, uint64(3)*entryWidth, s.index.size)
+	record, err := s.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, []byte("c"), record.Value)
+}
+
+func TestLogReaderDecompresses(t *testing.T) {
+	dir, err := os.MkdirTemp("", "compression-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := Config{}
+	config.Compression.Codec = Flate
+	config.Compression.PerBatch = true
+	log, err := NewLog(dir, config)
+	require.NoError(t, err)
+	defer log.Close()
+	_, err = log.AppendBatch([]*v1.Record{{Value: []byte("a")}, {Value: []byte("b")}})
+	require.NoError(t, err)
+
+	// The reader returns a plain frame for every record
+	b, err := io.ReadAll(log.Reader())
+	require.NoError(t, err)
+	for _, want := range []string{"a", "b"} {
+		require.Equal(t, frameVersion1, b[0])
+		n := enc.Uint64(b[:lenWidth]) & frameLenMask
+		record := &v1.Record{}
+		require.NoError(t, proto.Unmarshal(b[frameHeaderWidth:frameHeaderWidth+n], record))
+		require.Equal(t, []byte(want), record.Value)
+		b = b[frameHeaderWidth+n:]
+	}
+	require.Empty(t, b)
+}
@@ -1,9 +1,109 @@
 package log
 
+import "time"
+
+const (
+	// defaultMaxStoreBytes rolls segments at 1GiB
+	defaultMaxStoreBytes = 1 << 30
+	// defaultMaxIndexBytes indexes up to 655360 records per segment
+	defaultMaxIndexBytes = 10 << 20
+)
+
 type Config struct {
 	Segment struct {
 		MaxIndexBytes uint64
 		MaxStoreBytes uint64
 		InitialOffset uint64
+		// MaxRecordBytes is the largest record, marshaled, that can be
+		// appended, 0 allows any record that fits in an empty segment
+		MaxRecordBytes uint64
+	}
+	Index struct {
+		// IntervalRecords and IntervalBytes make the index sparse: a frame
+		// only gets an entry once that many records or bytes of store were
+		// appended since the last one, reads then scan the store from the
+		// entry before the record. 0 for both indexes every record.
+		IntervalRecords uint64
+		IntervalBytes   uint64
+	}
+	Durability struct {
+		// Sync decides when appended records are synced to disk, Append only
+		// returns once the record reached that point
+		Sync SyncPolicy
+		// SyncRecords and SyncInterval bound how long records stay unsynced
+		// with SyncPeriodic, whichever is reached first
+		SyncRecords  uint64
+		SyncInterval time.Duration
+	}
+	Retention struct {
+		// MaxBytes is the size of the stores above which the oldest segments
+		// are removed, 0 keeps every segment
+		MaxBytes uint64
+		// MaxAge is how long a segment is kept after its newest record was
+		// appended, 0 keeps every segment
+		MaxAge time.Duration
+		// MinSegments is the number of segments that are always kept
+		MinSegments int
+		// CheckInterval is how often retention is applied
+		CheckInterval time.Duration
+	}
+	Compaction struct {
+		// Enabled compacts the sealed segments in the background, keeping only
+		// the newest record for every key
+		Enabled bool
+		// DeleteRetention is how long a tombstone is kept around, so that
+		// consumers get to see the key was deleted, 0 keeps it for a day
+		DeleteRetention time.Duration
+		// CheckInterval is how often the log is compacted
+		CheckInterval time.Duration
+	}
+	Compression struct {
+		// Codec compresses records before they are written, nil writes them
+		// as they are. Records written with any registered codec can be read
+		// whatever the codec is set to.
+		Codec Codec
+		// PerBatch compresses the records written together, by AppendBatch or
+		// a group commit, into a single frame instead of one by one
+		PerBatch bool
+	}
+	Encryption struct {
+		// Keys encrypts records with AES-GCM before they are written, nil
+		// writes them in plaintext. Encrypted records need the key they were
+		// written with to be read.
+		Keys KeyProvider
 	}
+	Timestamps struct {
+		// UseProducerTime keeps the timestamps set by producers, records
+		// without one are still stamped with the time they are appended at
+		UseProducerTime bool
+	}
+	GroupCommit struct {
+		// Enabled batches concurrent Append calls into a single write to the
+		// store and a single sync
+		Enabled bool
+		// MaxBatch caps the number of records written at once
+		MaxBatch int
+	}
+	ReadOnly struct {
+		// Enabled opens the log for reads only: its files are mapped
+		// read-only and never changed, appends and truncations fail with
+		// ErrReadOnly. The directory isn't locked, so the log can be read
+		// while another process is writing it.
+		Enabled bool
+		// RefreshInterval is how often the records and segments a writer
+		// added are picked up, 0 refreshes every second
+		RefreshInterval time.Duration
+	}
+}
+
+// sparseIndex reports whether the config asks for a sparse index
+func (c Config) sparseIndex() bool {
+	return c.Index.IntervalRecords > 0 || c.Index.IntervalBytes > 0
+}
+
+// indexDue reports whether a sparse index gets an entry for a frame that
+// comes records and bytes after the last entry
+func (c Config) indexDue(records, bytes uint64) bool {
+	return (c.Index.IntervalRecords > 0 && records >= c.Index.IntervalRecords) ||
+		(c.Index.IntervalBytes > 0 && bytes >= c.Index.IntervalBytes)
 }
@@ -0,0 +1,159 @@
+package log
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// SyncPolicy decides when records appended to a log are synced to disk
+type SyncPolicy int
+
+const (
+	// SyncOS writes every record to its files before Append returns and
+	// leaves syncing them to disk to the operating system
+	SyncOS SyncPolicy = iota
+	// SyncEveryAppend syncs the store and the index before Append returns
+	SyncEveryAppend
+	// SyncPeriodic syncs every Durability.SyncRecords records or every
+	// Durability.SyncInterval, Append returns once its record was synced
+	SyncPeriodic
+)
+
+const defaultSyncInterval = 100 * time.Millisecond
+
+var syncPolicyNames = map[SyncPolicy]string{
+	SyncOS:          "os",
+	SyncEveryAppend: "append",
+	SyncPeriodic:    "periodic",
+}
+
+func (p SyncPolicy) String() string {
+	if name, ok := syncPolicyNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("SyncPolicy(%d)", int(p))
+}
+
+func (p SyncPolicy) MarshalText() ([]byte, error) {
+	if _, ok := syncPolicyNames[p]; !ok {
+		return nil, fmt.Errorf("unknown sync policy %d", int(p))
+	}
+	return []byte(p.String()), nil
+}
+
+func (p *SyncPolicy) UnmarshalText(text []byte) error {
+	for policy, name := range syncPolicyNames {
+		if name == string(text) {
+			*p = policy
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown sync policy %q", text)
+}
+
+// syncer makes records appended to a log durable according to its Durability
+// config. Unless stated otherwise its methods must be called with the log
+// lock held.
+type syncer struct {
+	log *Log
+	// unsynced is the number of records appended since the last sync
+	unsynced uint64
+	// durable is passed by every record that reached the durability point
+	durable  *watermark
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func newSyncer(l *Log) *syncer {
+	s := &syncer{
+		log:     l,
+		durable: newWatermark(l.activeSegment.nextOffset),
+	}
+	if l.Config.Durability.Sync == SyncPeriodic {
+		s.stop = make(chan struct{})
+		s.done = make(chan struct{})
+		go s.run(l.Config.Durability.SyncInterval)
+	}
+	return s
+}
+
+// appended is called after n records were appended to the active segment
+func (s *syncer) appended(n uint64) error {
+	segment := s.log.activeSegment
+	c := s.log.Config.Durability
+	switch c.Sync {
+	case SyncEveryAppend:
+		if err := segment.Sync(); err != nil {
+			return err
+		}
+	case SyncPeriodic:
+		s.unsynced += n
+		if c.SyncRecords == 0 || s.unsynced < c.SyncRecords {
+			return nil
+		}
+		return s.sync()
+	default:
+		if err := segment.Flush(); err != nil {
+			return err
+		}
+	}
+	s.durable.advance(segment.nextOffset)
+	return nil
+}
+
+// sync syncs the records appended to the active segment since the last sync
+func (s *syncer) sync() error {
+	if s.unsynced == 0 {
+		return nil
+	}
+	segment := s.log.activeSegment
+	if err := segment.Sync(); err != nil {
+		// There is no telling which records made it to disk, so nothing
+		// waiting for them can succeed anymore
+		s.durable.fail(fmt.Errorf("syncing segment %d: %w", segment.baseOffset, err))
+		return err
+	}
+	s.unsynced = 0
+	s.durable.advance(segment.nextOffset)
+	return nil
+}
+
+// truncated is called after the records at the end of the log were truncated
+// and the remaining ones synced
+func (s *syncer) truncated() {
+	s.unsynced = 0
+	s.durable.reset(s.log.activeSegment.nextOffset)
+}
+
+// run syncs the log every interval until stopped
+func (s *syncer) run(interval time.Duration) {
+	defer close(s.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.log.mu.Lock()
+			err := s.sync()
+			s.log.mu.Unlock()
+			if err != nil {
+				slog.Error("periodic sync failed", "dir", s.log.Dir, "error", err)
+			}
+		}
+	}
+}
+
+// close stops the periodic sync, it must be called without the log lock
+func (s *syncer) close() {
+	s.stopOnce.Do(func() {
+		if s.stop != nil {
+			close(s.stop)
+			<-s.done
+		}
+	})
+}
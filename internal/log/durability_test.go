@@ -0,0 +1,131 @@
+package log
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	v1 "github.com/adityavit/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyncPolicyText(t *testing.T) {
+	for _, want := range []SyncPolicy{SyncOS, SyncEveryAppend, SyncPeriodic} {
+		text, err := want.MarshalText()
+		require.NoError(t, err)
+		var got SyncPolicy
+		require.NoError(t, got.UnmarshalText(text))
+		require.Equal(t, want, got)
+	}
+	var p SyncPolicy
+	require.Error(t, p.UnmarshalText([]byte("never")))
+}
+
+func TestDurability(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, config Config){
+		"os writes records to the file":        testSyncOS,
+		"every append syncs before returning":  testSyncEveryAppend,
+		"periodic syncs after enough records":  testSyncPeriodicRecords,
+		"periodic syncs after the interval":    testSyncPeriodicInterval,
+		"close syncs records waiting for sync": testSyncOnClose,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			config := Config{}
+			config.Segment.MaxStoreBytes = 1024
+			config.Segment.MaxIndexBytes = 1024
+			config.Durability.SyncInterval = time.Hour
+			fn(t, config)
+		})
+	}
+}
+
+func storeFileSize(t *testing.T, log *Log) int64 {
+	fi, err := os.Stat(log.activeSegment.store.Name())
+	require.NoError(t, err)
+	return fi.Size()
+}
+
+func testSyncOS(t *testing.T, config Config) {
+	config.Durability.Sync = SyncOS
+	log := newTestLog(t, config)
+	defer log.Close()
+
+	_, err := log.Append(&v1.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, int64(log.activeSegment.store.size), storeFileSize(t, log))
+}
+
+func testSyncEveryAppend(t *testing.T, config Config) {
+	config.Durability.Sync = SyncEveryAppend
+	log := newTestLog(t, config)
+	defer log.Close()
+
+	off, err := log.Append(&v1.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, int64(log.activeSegment.store.size), storeFileSize(t, log))
+	// The record is durable already, so waiting for it doesn't block
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.NoError(t, log.syncer.durable.wait(ctx, off))
+}
+
+func testSyncPeriodicRecords(t *testing.T, config Config) {
+	config.Durability.Sync = SyncPeriodic
+	config.Durability.SyncRecords = 2
+	log := newTestLog(t, config)
+	defer log.Close()
+
+	// The first append waits for the second one to trigger the sync
+	first := make(chan error)
+	go func() {
+		_, err := log.Append(&v1.Record{Value: []byte("first")})
+		first <- err
+	}()
+	require.Eventually(t, func() bool {
+		log.mu.RLock()
+		defer log.mu.RUnlock()
+		return log.syncer.unsynced == 1
+	}, time.Second, time.Millisecond)
+	select {
+	case <-first:
+		t.Fatal("append returned before its record was synced")
+	default:
+	}
+
+	off, err := log.Append(&v1.Record{Value: []byte("second")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	require.NoError(t, <-first)
+	require.Equal(t, uint64(0), log.syncer.unsynced)
+	require.Equal(t, int64(log.activeSegment.store.size), storeFileSize(t, log))
+}
+
+func testSyncPeriodicInterval(t *testing.T, config Config) {
+	config.Durability.Sync = SyncPeriodic
+	config.Durability.SyncInterval = 10 * time.Millisecond
+	log := newTestLog(t, config)
+	defer log.Close()
+
+	_, err := log.Append(&v1.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, int64(log.activeSegment.store.size), storeFileSize(t, log))
+}
+
+func testSyncOnClose(t *testing.T, config Config) {
+	config.Durability.Sync = SyncPeriodic
+	log := newTestLog(t, config)
+
+	done := make(chan error)
+	go func() {
+		_, err := log.Append(&v1.Record{Value: []byte("hello world")})
+		done <- err
+	}()
+	require.Eventually(t, func() bool {
+		log.mu.RLock()
+		defer log.mu.RUnlock()
+		return log.syncer.unsynced == 1
+	}, time.Second, time.Millisecond)
+	require.NoError(t, log.Close())
+	require.NoError(t, <-done)
+}
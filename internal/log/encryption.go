@@ -0,0 +1,164 @@
+package log
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// frameFlagEncrypted marks a frame whose payload is encrypted
+const frameFlagEncrypted byte = 1 << 5
+
+var (
+	// ErrKeyNotFound is returned when a record is encrypted with a key the
+	// KeyProvider of the log doesn't have
+	ErrKeyNotFound = errors.New("encryption key not found")
+	// ErrWrongKey is returned when a record doesn't decrypt with the key
+	// that has its ID
+	ErrWrongKey = errors.New("record does not decrypt with its key")
+)
+
+// KeyProvider supplies the AES keys records are encrypted with. Every key has
+// an ID that is stored with the records it encrypted, so keys can be rotated
+// as long as the old ones can still be looked up.
+type KeyProvider interface {
+	// CurrentKey returns the key new records are encrypted with
+	CurrentKey() (id string, key []byte, err error)
+	// Key returns the key with the ID or an error wrapping ErrKeyNotFound
+	Key(id string) ([]byte, error)
+}
+
+// FileKeyProvider reads its keys from a JSON file of the form
+//
+//	{"current": "2024-06", "keys": {"2024-06": "<base64 key>", "2024-01": "<base64 key>"}}
+//
+// Keys are 16, 24 or 32 bytes long for AES-128, AES-192 or AES-256.
+type FileKeyProvider struct {
+	current string
+	keys    map[string][]byte
+}
+
+func NewFileKeyProvider(path string) (*FileKeyProvider, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Current string            `json:"current"`
+		Keys    map[string][]byte `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &file); err != nil {
+		return nil, fmt.Errorf("parsing key file %s: %w", path, err)
+	}
+	for id, key := range file.Keys {
+		if len(id) == 0 || len(id) > maxKeyIDLen {
+			return nil, fmt.Errorf("key ID %q in %s must be 1 to %d bytes long", id, path, maxKeyIDLen)
+		}
+		if _, err := aes.NewCipher(key); err != nil {
+			return nil, fmt.Errorf("key %q in %s: %w", id, path, err)
+		}
+	}
+	if _, ok := file.Keys[file.Current]; !ok {
+		return nil, fmt.Errorf("current key %q in %s: %w", file.Current, path, ErrKeyNotFound)
+	}
+	return &FileKeyProvider{current: file.Current, keys: file.Keys}, nil
+}
+
+func (p *FileKeyProvider) CurrentKey() (string, []byte, error) {
+	return p.current, p.keys[p.current], nil
+}
+
+func (p *FileKeyProvider) Key(id string) ([]byte, error) {
+	key, ok := p.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("key %q: %w", id, ErrKeyNotFound)
+	}
+	return key, nil
+}
+
+// An encrypted payload holds the ID of the key, the nonce and the sealed
+// payload:
+//
+//	| key ID length (1) | key ID | nonce (12) | ciphertext and tag |
+const maxKeyIDLen = 255
+
+// encrypt seals the payloads with the current key of the provider
+func encrypt(keys KeyProvider, payloads [][]byte) ([][]byte, error) {
+	id, key, err := keys.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	if len(id) == 0 || len(id) > maxKeyIDLen {
+		return nil, fmt.Errorf("key ID %q must be 1 to %d bytes long", id, maxKeyIDLen)
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, fmt.Errorf("key %q: %w", id, err)
+	}
+	encrypted := make([][]byte, len(payloads))
+	for i, p := range payloads {
+		out := make([]byte, 0, 1+len(id)+aead.NonceSize()+len(p)+aead.Overhead())
+		out = append(out, byte(len(id)))
+		out = append(out, id...)
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		out = append(out, nonce...)
+		encrypted[i] = aead.Seal(out, nonce, p, nil)
+	}
+	return encrypted, nil
+}
+
+// decrypt opens an encrypted payload, errors about the key wrap
+// ErrKeyNotFound or ErrWrongKey and anything else means the payload is
+// malformed
+func decrypt(keys KeyProvider, p []byte) ([]byte, error) {
+	if len(p) == 0 || len(p) < 1+int(p[0]) {
+		return nil, errors.New("encrypted payload too short")
+	}
+	id := string(p[1 : 1+p[0]])
+	p = p[1+len(id):]
+	if keys == nil {
+		return nil, fmt.Errorf("key %q: no key provider configured: %w", id, ErrKeyNotFound)
+	}
+	key, err := keys.Key(id)
+	if err != nil {
+		if !errors.Is(err, ErrKeyNotFound) {
+			// The provider failing to look the key up doesn't make the
+			// record any less valid
+			return nil, fmt.Errorf("key %q: %w: %w", id, ErrKeyNotFound, err)
+		}
+		return nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, fmt.Errorf("key %q: %w: %w", id, ErrWrongKey, err)
+	}
+	if len(p) < aead.NonceSize() {
+		return nil, errors.New("encrypted payload too short")
+	}
+	plain, err := aead.Open(nil, p[:aead.NonceSize()], p[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("key %q: %w", id, ErrWrongKey)
+	}
+	return plain, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// isKeyError tells apart a record that can't be decrypted from a corrupt one,
+// recovery must not cut off records just because their key is missing
+func isKeyError(err error) bool {
+	return errors.Is(err, ErrKeyNotFound) || errors.Is(err, ErrWrongKey)
+}
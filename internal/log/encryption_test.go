@@ -0,0 +1,105 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	v1 "github.com/adityavit/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func writeKeyFile(t *testing.T, dir, current string, keys map[string][]byte) *FileKeyProvider {
+	b, err := json.Marshal(map[string]any{"current": current, "keys": keys})
+	require.NoError(t, err)
+	path := filepath.Join(dir, current+".json")
+	require.NoError(t, os.WriteFile(path, b, 0600))
+	p, err := NewFileKeyProvider(path)
+	require.NoError(t, err)
+	return p
+}
+
+func TestFileKeyProvider(t *testing.T) {
+	dir, err := os.MkdirTemp("", "keys-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	key := bytes.Repeat([]byte{1}, 32)
+	p := writeKeyFile(t, dir, "k1", map[string][]byte{"k1": key})
+	id, got, err := p.CurrentKey()
+	require.NoError(t, err)
+	require.Equal(t, "k1", id)
+	require.Equal(t, key, got)
+	_, err = p.Key("k2")
+	require.ErrorIs(t, err, ErrKeyNotFound)
+
+	// Keys must be valid AES keys and the current one must exist
+	for _, file := range []string{
+		`{"current": "k1", "keys": {"k1": "AQID"}}`,
+		`{"current": "k2", "keys": {"k1": "AQEBAQEBAQEBAQEBAQEBAQ=="}}`,
+	} {
+		path := filepath.Join(dir, "bad.json")
+		require.NoError(t, os.WriteFile(path, []byte(file), 0600))
+		_, err := NewFileKeyProvider(path)
+		require.Error(t, err)
+	}
+}
+
+func TestSegmentEncryption(t *testing.T) {
+	dir, err := os.MkdirTemp("", "encryption-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	keyDir, err := os.MkdirTemp("", "keys-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(keyDir)
+
+	k1, k2 := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 16)
+	config := Config{}
+	config.Segment.MaxStoreBytes = 1024
+	config.Segment.MaxIndexBytes = 1024
+	config.Compression.Codec = Gzip
+	config.Encryption.Keys = writeKeyFile(t, keyDir, "k1", map[string][]byte{"k1": k1})
+	s, err := NewSegment(dir, 0, config)
+	require.NoError(t, err)
+	_, err = s.Append(&v1.Record{Value: []byte("customer event")})
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+	b, err := os.ReadFile(s.store.Name())
+	require.NoError(t, err)
+	require.NotContains(t, string(b), "customer event")
+
+	// After rotating to k2 records encrypted with k1 are still readable
+	config.Encryption.Keys = writeKeyFile(t, keyDir, "k2", map[string][]byte{"k1": k1, "k2": k2})
+	s, err = NewSegment(dir, 0, config)
+	require.NoError(t, err)
+	_, err = s.AppendBatch([]*v1.Record{{Value: []byte("a")}, {Value: []byte("b")}})
+	require.NoError(t, err)
+	for off, want := range []string{"customer event", "a", "b"} {
+		record, err := s.Read(uint64(off))
+		require.NoError(t, err)
+		require.Equal(t, []byte(want), record.Value)
+	}
+	require.NoError(t, s.Close())
+
+	// Without k1 its records can't be read, but they aren't mistaken for
+	// corrupt ones either
+	config.Encryption.Keys = writeKeyFile(t, keyDir, "k2", map[string][]byte{"k2": k2})
+	s, err = NewSegment(dir, 0, config)
+	require.NoError(t, err)
+	_, err = s.Read(0)
+	require.ErrorIs(t, err, ErrKeyNotFound)
+	record, err := s.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), record.Value)
+	require.NoError(t, s.Close())
+
+	storeSize := s.store.size
+	require.NoError(t, os.Remove(s.index.Name()))
+	_, err = NewSegment(dir, 0, config)
+	require.ErrorIs(t, err, ErrKeyNotFound)
+	fi, err := os.Stat(s.store.Name())
+	require.NoError(t, err)
+	require.Equal(t, int64(storeSize), fi.Size())
+}
@@ -0,0 +1,48 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The errors the log returns, callers tell them apart with errors.Is and
+// errors.As since most of them are wrapped with more context
+var (
+	// ErrOffsetOutOfRange is returned when reading past the end of the log
+	ErrOffsetOutOfRange = errors.New("offset out of range")
+	// ErrLogClosed is returned for reads and appends that reach a closed log
+	ErrLogClosed = errors.New("log is closed")
+	// ErrSegmentFull is returned when records don't fit in a segment
+	ErrSegmentFull = errors.New("segment is full")
+	// ErrRecordTooLarge is returned when a record doesn't fit in an empty
+	// segment or a frame
+	ErrRecordTooLarge = errors.New("record is too large")
+	// ErrLogLocked is returned when opening a log that another process or
+	// Log already has open
+	ErrLogLocked = errors.New("log directory is locked")
+	// ErrReadOnly is returned for changes to a log opened read-only
+	ErrReadOnly = errors.New("log is read-only")
+)
+
+// ErrOffsetTruncated is returned when reading an offset below the start of
+// the log
+type ErrOffsetTruncated struct {
+	Offset uint64
+	Start  uint64
+}
+
+func (e *ErrOffsetTruncated) Error() string {
+	return fmt.Sprintf("offset %d was truncated, the log starts at %d", e.Offset, e.Start)
+}
+
+// ErrCorruptRecord is returned when a record in a store fails its checksum or
+// its frame cannot be decoded.
+type ErrCorruptRecord struct {
+	Segment string
+	Pos     uint64
+	Reason  string
+}
+
+func (e *ErrCorruptRecord) Error() string {
+	return fmt.Sprintf("corrupt record in %s at position %d: %s", e.Segment, e.Pos, e.Reason)
+}
@@ -0,0 +1,152 @@
+package log
+
+import (
+	"errors"
+	"sync"
+
+	v1 "github.com/adityavit/proglog/api/v1"
+)
+
+const defaultMaxBatch = 128
+
+// appendRequest is an Append call waiting for the committer
+type appendRequest struct {
+	record *v1.Record
+	offset uint64
+	err    error
+	done   chan struct{}
+}
+
+// committer batches concurrent Append calls. While one batch is being written
+// and synced the next one queues up, so each batch costs a single store write
+// and a single sync no matter how many producers it serves.
+type committer struct {
+	log      *Log
+	maxBatch int
+	requests chan *appendRequest
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func newCommitter(l *Log) *committer {
+	maxBatch := l.Config.GroupCommit.MaxBatch
+	if maxBatch <= 0 {
+		maxBatch = defaultMaxBatch
+	}
+	c := &committer{
+		log:      l,
+		maxBatch: maxBatch,
+		requests: make(chan *appendRequest, maxBatch),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+// append queues the record for the next batch and returns its offset once
+// the batch was written
+func (c *committer) append(record *v1.Record) (uint64, error) {
+	req := &appendRequest{
+		record: record,
+		done:   make(chan struct{}),
+	}
+	select {
+	case c.requests <- req:
+	case <-c.stop:
+		return 0, ErrLogClosed
+	}
+	select {
+	case <-req.done:
+	case <-c.done:
+		// The request raced with close, it was either completed by the
+		// final drain or it never will be
+		select {
+		case <-req.done:
+		default:
+			return 0, ErrLogClosed
+		}
+	}
+	return req.offset, req.err
+}
+
+func (c *committer) run() {
+	defer close(c.done)
+	batch := make([]*appendRequest, 0, c.maxBatch)
+	for {
+		select {
+		case <-c.stop:
+			c.drain()
+			return
+		case req := <-c.requests:
+			batch = append(batch[:0], req)
+		}
+		// Take whatever queued up while the previous batch was written
+	collect:
+		for len(batch) < c.maxBatch {
+			select {
+			case req := <-c.requests:
+				batch = append(batch, req)
+			default:
+				break collect
+			}
+		}
+		c.commit(batch)
+	}
+}
+
+// commit writes the batch and completes every request in it. A record that
+// doesn't fit in any segment only fails its own request, the ones after it
+// are still written.
+func (c *committer) commit(batch []*appendRequest) {
+	records := make([]*v1.Record, len(batch))
+	for i, req := range batch {
+		records[i] = req.record
+	}
+	c.log.mu.Lock()
+	for pending := batch; len(pending) > 0; {
+		first, n, err := c.log.appendRecords(records)
+		for i, req := range pending[:n] {
+			req.offset = first + uint64(i)
+		}
+		pending, records = pending[n:], records[n:]
+		if err == nil {
+			break
+		}
+		if errors.Is(err, ErrRecordTooLarge) {
+			pending[0].err = err
+			pending, records = pending[1:], records[1:]
+			continue
+		}
+		for _, req := range pending {
+			req.err = err
+		}
+		break
+	}
+	c.log.mu.Unlock()
+	for _, req := range batch {
+		close(req.done)
+	}
+}
+
+// drain fails the requests still queued when the committer stops
+func (c *committer) drain() {
+	for {
+		select {
+		case req := <-c.requests:
+			req.err = ErrLogClosed
+			close(req.done)
+		default:
+			return
+		}
+	}
+}
+
+// close stops the committer, it must be called without the log lock
+func (c *committer) close() {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+		<-c.done
+	})
+}
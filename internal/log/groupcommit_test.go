@@ -0,0 +1,136 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	v1 "github.com/adityavit/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroupCommit(t *testing.T) {
+	dir, err := os.MkdirTemp("", "group-commit-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := Config{}
+	config.Segment.MaxStoreBytes = 1024
+	config.Segment.MaxIndexBytes = 1024
+	config.Durability.Sync = SyncEveryAppend
+	config.GroupCommit.Enabled = true
+	config.GroupCommit.MaxBatch = 16
+	log, err := NewLog(dir, config)
+	require.NoError(t, err)
+
+	const producers, records = 8, 50
+	var wg sync.WaitGroup
+	offsets := make([][]uint64, producers)
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < records; i++ {
+				off, err := log.Append(&v1.Record{Value: []byte(fmt.Sprintf("%d-%d", p, i))})
+				require.NoError(t, err)
+				offsets[p] = append(offsets[p], off)
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	// Every record got its own offset and can be read back from it
+	seen := make(map[uint64]bool)
+	for p, offs := range offsets {
+		for i, off := range offs {
+			require.False(t, seen[off])
+			seen[off] = true
+			read, err := log.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("%d-%d", p, i)), read.Value)
+		}
+	}
+	off, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(producers*records-1), off)
+	require.Greater(t, len(log.segments), 1)
+
+	require.NoError(t, log.Close())
+	_, err = log.Append(&v1.Record{Value: []byte("closed")})
+	require.ErrorIs(t, err, ErrLogClosed)
+}
+
+func TestGroupCommitRecordTooLarge(t *testing.T) {
+	dir, err := os.MkdirTemp("", "group-commit-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := Config{}
+	config.Segment.MaxStoreBytes = 1024
+	config.Segment.MaxIndexBytes = 1024
+	config.GroupCommit.Enabled = true
+	log, err := NewLog(dir, config)
+	require.NoError(t, err)
+	defer log.Close()
+
+	// The record that fits in no segment fails alone, the ones queued
+	// around it in the same batch are written
+	batch := []*appendRequest{
+		{record: &v1.Record{Value: []byte("first")}, done: make(chan struct{})},
+		{record: &v1.Record{Value: make([]byte, 2048)}, done: make(chan struct{})},
+		{record: &v1.Record{Value: []byte("second")}, done: make(chan struct{})},
+	}
+	log.committer.commit(batch)
+	require.NoError(t, batch[0].err)
+	require.ErrorIs(t, batch[1].err, ErrRecordTooLarge)
+	require.NoError(t, batch[2].err)
+	for i, want := range map[int]string{0: "first", 2: "second"} {
+		read, err := log.Read(batch[i].offset)
+		require.NoError(t, err)
+		require.Equal(t, []byte(want), read.Value)
+	}
+	require.Equal(t, uint64(1), batch[2].offset)
+	require.Len(t, log.segments, 1)
+}
+
+func BenchmarkAppend(b *testing.B) {
+	for _, sync := range []SyncPolicy{SyncOS, SyncEveryAppend} {
+		for _, group := range []bool{false, true} {
+			name := fmt.Sprintf("sync=%s/per-record", sync)
+			if group {
+				name = fmt.Sprintf("sync=%s/group-commit", sync)
+			}
+			b.Run(name, func(b *testing.B) {
+				benchmarkAppend(b, sync, group)
+			})
+		}
+	}
+}
+
+func benchmarkAppend(b *testing.B, sync SyncPolicy, group bool) {
+	dir, err := os.MkdirTemp("", "append-bench")
+	require.NoError(b, err)
+	defer os.RemoveAll(dir)
+
+	config := Config{}
+	config.Segment.MaxStoreBytes = 64 << 20
+	config.Segment.MaxIndexBytes = 8 << 20
+	config.Durability.Sync = sync
+	config.GroupCommit.Enabled = group
+	log, err := NewLog(dir, config)
+	require.NoError(b, err)
+	defer log.Close()
+
+	value := make([]byte, 256)
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := log.Append(&v1.Record{Value: value}); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
@@ -3,47 +3,226 @@
 package log
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"sort"
 
 	mmap "github.com/edsrzf/mmap-go"
 )
 
+// The index file starts with a header followed by the entries:
+//
+//	| magic (4) | version (1) | entry width (1) | flags (1) | reserved (1) |
+//	| relative offset (8) | position (8) | ...
+//
+// A dense index has an entry for every record, a sparse one only for the
+// first record of some of the frames, see Config.Index.
+//
+// Index files written before the header was introduced hold entries with a 4
+// byte relative offset and no header, they are migrated when opened.
 const (
-	offsetWidth   = 4
-	positionWidth = 8
-	entryWidth    = offsetWidth + positionWidth
+	indexMagic             = "PLIX"
+	indexVersion1     byte = 1
+	indexHeaderWidth       = 8
+	indexFlagsAt           = len(indexMagic) + 2
+	indexFlagSparse   byte = 1 << 0
+	offsetWidth            = 8
+	positionWidth          = 8
+	entryWidth             = offsetWidth + positionWidth
+	legacyOffsetWidth      = 4
+	legacyEntryWidth       = legacyOffsetWidth + positionWidth
+	// migratingExt is the index being written by a migration, it's removed
+	// when the log is opened again after a crash
+	migratingExt = ".migrating"
 )
 
 type index struct {
 	file *os.File
 	mmap mmap.MMap
+	// entries is the part of the mapping after the header
+	entries []byte
+	// size is the number of bytes of entries written
 	size uint64
+	// sparse is set for an index that doesn't have an entry for every record
+	sparse bool
+	// readOnly is set for an index mapped read-only, it's never written
+	readOnly bool
 }
 
+// newIndex opens an index with room for MaxIndexBytes of entries, or as many
+// as it already holds when it was written with a larger limit. A new index is
+// sparse or dense as the config asks for, an existing one as it was written.
 func newIndex(f *os.File, c Config) (*index, error) {
-	idx := &index{
-		file: f,
-	}
 	fi, err := os.Stat(f.Name())
 	if err != nil {
 		return nil, err
 	}
 	size := uint64(fi.Size())
-	idx.size = size
+	sparse := c.sparseIndex()
+	if size > 0 {
+		header := make([]byte, min(size, indexHeaderWidth))
+		if _, err := f.ReadAt(header, 0); err != nil {
+			return nil, err
+		}
+		if !bytes.HasPrefix(header, []byte(indexMagic)) {
+			if f, size, err = migrateIndex(f); err != nil {
+				return nil, fmt.Errorf("migrating index %s: %w", fi.Name(), err)
+			}
+		} else if err := checkIndexHeader(header); err != nil {
+			return nil, fmt.Errorf("opening index %s: %w", fi.Name(), err)
+		}
+		// Legacy indexes are dense
+		sparse = len(header) == indexHeaderWidth && header[indexFlagsAt]&indexFlagSparse != 0
+	}
+	idx := &index{
+		file:   f,
+		sparse: sparse,
+	}
+	if size > indexHeaderWidth {
+		idx.size = size - indexHeaderWidth
+	}
 	// Truncate the file to the size of the segment
-	if err := os.Truncate(f.Name(), int64(c.Segment.MaxIndexBytes)); err != nil {
+	capacity := indexHeaderWidth + max(c.Segment.MaxIndexBytes, idx.size)
+	if err := os.Truncate(f.Name(), int64(capacity)); err != nil {
 		return nil, err
 	}
 	idx.mmap, err = mmap.Map(f, mmap.RDWR, 0)
 	if err != nil {
 		return nil, err
 	}
+	idx.entries = idx.mmap[indexHeaderWidth:]
+	if size == 0 {
+		idx.writeHeader()
+	}
 	return idx, nil
 }
 
+// errIndexNotReady is returned when opening an index read-only that has no
+// header yet, the writer may still be creating it
+var errIndexNotReady = errors.New("index is not ready")
+
+// openIndexReadOnly maps an index read-only as it is, with every entry the
+// file has room for counted as written
+func openIndexReadOnly(f *os.File) (*index, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() < indexHeaderWidth {
+		return nil, errIndexNotReady
+	}
+	header := make([]byte, indexHeaderWidth)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(header, []byte(indexMagic)) {
+		if bytes.Equal(header, make([]byte, indexHeaderWidth)) {
+			return nil, errIndexNotReady
+		}
+		return nil, fmt.Errorf("opening index %s: it needs migrating, which a read-only log can't do", fi.Name())
+	}
+	if err := checkIndexHeader(header); err != nil {
+		return nil, fmt.Errorf("opening index %s: %w", fi.Name(), err)
+	}
+	idx := &index{
+		file:     f,
+		sparse:   header[indexFlagsAt]&indexFlagSparse != 0,
+		readOnly: true,
+	}
+	if idx.mmap, err = mmap.Map(f, mmap.RDONLY, 0); err != nil {
+		return nil, err
+	}
+	idx.entries = idx.mmap[indexHeaderWidth:]
+	idx.size = uint64(len(idx.entries))
+	return idx, nil
+}
+
+// writeHeader writes the header of the current format
+func (i *index) writeHeader() {
+	copy(i.mmap, indexMagic)
+	i.mmap[len(indexMagic)] = indexVersion1
+	i.mmap[len(indexMagic)+1] = entryWidth
+	i.mmap[indexFlagsAt] = 0
+	if i.sparse {
+		i.mmap[indexFlagsAt] = indexFlagSparse
+	}
+}
+
+// checkIndexHeader returns an error unless the header is of a format this
+// version reads
+func checkIndexHeader(header []byte) error {
+	if len(header) < indexHeaderWidth {
+		return fmt.Errorf("truncated header")
+	}
+	version, width := header[len(indexMagic)], header[len(indexMagic)+1]
+	if version != indexVersion1 || width != entryWidth {
+		return fmt.Errorf("unsupported version %d with %d byte entries", version, width)
+	}
+	return nil
+}
+
+// migrateIndex rewrites an index without a header in the current format and
+// returns the new file and its size. The index is written next to the old one
+// and renamed over it, so a crash leaves either of them.
+func migrateIndex(f *os.File) (*os.File, uint64, error) {
+	b, err := os.ReadFile(f.Name())
+	if err != nil {
+		return nil, 0, err
+	}
+	// After a crash the written entries are followed by zeroes up to
+	// MaxIndexBytes, only the first entry can legitimately be all zeroes
+	legacy := len(b) / legacyEntryWidth
+	zeroes := make([]byte, legacyEntryWidth)
+	written := sort.Search(legacy, func(j int) bool {
+		return j > 0 && bytes.Equal(b[j*legacyEntryWidth:(j+1)*legacyEntryWidth], zeroes)
+	})
+	migrated := make([]byte, indexHeaderWidth+written*entryWidth)
+	idx := &index{mmap: migrated, entries: migrated[indexHeaderWidth:]}
+	idx.writeHeader()
+	for j := 0; j < written; j++ {
+		entry := b[j*legacyEntryWidth:]
+		off := binary.BigEndian.Uint32(entry[:legacyOffsetWidth])
+		pos := binary.BigEndian.Uint64(entry[legacyOffsetWidth:legacyEntryWidth])
+		if err := idx.Write(uint64(off), pos); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	name := f.Name()
+	tmp := name + migratingExt
+	if err := writeFileSync(tmp, migrated); err != nil {
+		return nil, 0, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, 0, err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		return nil, 0, err
+	}
+	if err := syncDir(filepath.Dir(name)); err != nil {
+		return nil, 0, err
+	}
+	slog.Info("migrated index to version 1", "index", name, "entries", written)
+	f, err = os.OpenFile(name, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+	return f, uint64(len(migrated)), nil
+}
+
 func (i *index) Close() error {
+	if i.readOnly {
+		if err := i.mmap.Unmap(); err != nil {
+			return err
+		}
+		return i.file.Close()
+	}
 	if err := i.mmap.Flush(); err != nil {
 		return err
 	}
@@ -53,7 +232,7 @@ func (i *index) Close() error {
 	if err := i.file.Sync(); err != nil {
 		return err
 	}
-	if err := i.file.Truncate(int64(i.size)); err != nil {
+	if err := i.file.Truncate(int64(indexHeaderWidth + i.size)); err != nil {
 		return err
 	}
 	if err := i.file.Close(); err != nil {
@@ -62,37 +241,120 @@ func (i *index) Close() error {
 	return nil
 }
 
+// Sync writes the mapped entries back to the file
+func (i *index) Sync() error {
+	return i.mmap.Flush()
+}
+
 // Read takes an index offset and returns the associated record offset and position in the store
-func (i *index) Read(offset int64) (out uint32, pos uint64, err error) {
+func (i *index) Read(offset int64) (out uint64, pos uint64, err error) {
 	if i.size == 0 {
 		return 0, 0, io.EOF
 	}
 	if offset == -1 {
 		// If offset is -1, we are reading the last entry
-		out = uint32(i.size/entryWidth) - 1
+		out = i.size/entryWidth - 1
 	} else {
-		out = uint32(offset)
+		out = uint64(offset)
 	}
-	pos = uint64(out) * entryWidth
-	if pos+entryWidth > uint64(i.size) {
+	pos = out * entryWidth
+	if pos+entryWidth > i.size {
 		return 0, 0, io.EOF
 	}
-	out = binary.BigEndian.Uint32(i.mmap[pos : pos+offsetWidth])
-	pos = binary.BigEndian.Uint64(i.mmap[pos+offsetWidth : pos+entryWidth])
+	out = binary.BigEndian.Uint64(i.entries[pos : pos+offsetWidth])
+	pos = binary.BigEndian.Uint64(i.entries[pos+offsetWidth : pos+entryWidth])
 	return
 }
 
+// Search returns the first entry for a relative offset at or after the given
+// one, there are gaps in the offsets of a compacted segment
+func (i *index) Search(offset uint64) (out uint64, pos uint64, err error) {
+	n := i.size / entryWidth
+	// Unless the segment was compacted the entry is right where the offset is
+	if offset < n {
+		if out, pos, err = i.Read(int64(offset)); err == nil && out == offset {
+			return out, pos, nil
+		}
+	}
+	j := sort.Search(int(n), func(j int) bool {
+		out, _, _ := i.Read(int64(j))
+		return out >= offset
+	})
+	if uint64(j) == n {
+		return 0, 0, io.EOF
+	}
+	return i.Read(int64(j))
+}
+
+// Floor returns the last entry for a relative offset at or before the given
+// one, or the first entry when there is none
+func (i *index) Floor(offset uint64) (out uint64, pos uint64, err error) {
+	j := sort.Search(int(i.size/entryWidth), func(j int) bool {
+		out, _, _ := i.Read(int64(j))
+		return out > offset
+	})
+	return i.Read(int64(max(j-1, 0)))
+}
+
 // Write takes an offset and a position and writes the record to the index
-func (i *index) Write(offset uint32, pos uint64) error {
-	if uint64(len(i.mmap)) < i.size+entryWidth {
+func (i *index) Write(offset uint64, pos uint64) error {
+	if uint64(len(i.entries)) < i.size+entryWidth {
 		return io.EOF
 	}
-	binary.BigEndian.PutUint32(i.mmap[i.size:i.size+offsetWidth], offset)
-	binary.BigEndian.PutUint64(i.mmap[i.size+offsetWidth:i.size+entryWidth], pos)
+	binary.BigEndian.PutUint64(i.entries[i.size:i.size+offsetWidth], offset)
+	binary.BigEndian.PutUint64(i.entries[i.size+offsetWidth:i.size+entryWidth], pos)
 	i.size += entryWidth
 	return nil
 }
 
+// validEntries returns the number of entries that were written to the index
+// and how many of them at the start of it point inside a store of storeSize
+// bytes. After a crash the index file is still truncated to MaxIndexBytes, so
+// the written entries are followed by zeroes.
+func (i *index) validEntries(storeSize uint64) (written, valid uint64) {
+	capacity := min(i.size, uint64(len(i.entries))) / entryWidth
+	// Only the first entry can legitimately be all zeroes, so the written
+	// entries end right before the first zeroed one after it
+	written = uint64(sort.Search(int(capacity), func(j int) bool {
+		return j > 0 && i.isZero(uint64(j))
+	}))
+	n := written
+	// Drop trailing entries that point past the end of the store or that
+	// don't come after the entry before them
+	for n > 0 {
+		off, pos, _ := i.Read(int64(n - 1))
+		if pos < storeSize {
+			if n == 1 {
+				break
+			}
+			prevOff, prevPos, _ := i.Read(int64(n - 2))
+			// The records of a batch frame share its position
+			if off > prevOff && pos >= prevPos {
+				break
+			}
+		}
+		n--
+	}
+	return written, n
+}
+
+func (i *index) isZero(entry uint64) bool {
+	for _, b := range i.entries[entry*entryWidth : (entry+1)*entryWidth] {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// truncate drops every entry after the first n, zeroing them so they can't be
+// mistaken for written entries later on
+func (i *index) truncate(n uint64) {
+	size := n * entryWidth
+	clear(i.entries[size:min(i.size, uint64(len(i.entries)))])
+	i.size = size
+}
+
 func (i *index) Name() string {
 	return i.file.Name()
 }
@@ -1,8 +1,10 @@
 package log
 
 import (
+	"encoding/binary"
 	"io"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -20,7 +22,7 @@ func TestIndex(t *testing.T) {
 
 	// Test Write
 	entries := []struct {
-		Off uint32
+		Off uint64
 		Pos uint64
 	}{
 		{Off: 0, Pos: 0},
@@ -50,6 +52,52 @@ func TestIndex(t *testing.T) {
 	// Read the last entry with offset -1
 	off, pos, err := idx.Read(-1)
 	require.NoError(t, err)
-	require.Equal(t, uint32(1), off)
+	require.Equal(t, uint64(1), off)
 	require.Equal(t, entries[1].Pos, pos)
 }
+
+func TestIndexMigrateLegacy(t *testing.T) {
+	dir, err := os.MkdirTemp("", "index_migrate_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// A legacy index left behind by a crash, its entries followed by zeroes
+	legacy := make([]byte, 10*legacyEntryWidth)
+	for j := 0; j < 3; j++ {
+		entry := legacy[j*legacyEntryWidth:]
+		binary.BigEndian.PutUint32(entry, uint32(j))
+		binary.BigEndian.PutUint64(entry[legacyOffsetWidth:], uint64(j*20))
+	}
+	name := filepath.Join(dir, "0.index")
+	require.NoError(t, os.WriteFile(name, legacy, 0644))
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	f, err := os.OpenFile(name, os.O_RDWR, 0644)
+	require.NoError(t, err)
+	idx, err := newIndex(f, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3)*entryWidth, idx.size)
+	for j := uint64(0); j < 3; j++ {
+		off, pos, err := idx.Read(int64(j))
+		require.NoError(t, err)
+		require.Equal(t, j, off)
+		require.Equal(t, j*20, pos)
+	}
+	require.NoError(t, idx.Write(3, 60))
+	require.NoError(t, idx.Close())
+
+	b, err := os.ReadFile(name)
+	require.NoError(t, err)
+	require.Equal(t, []byte(indexMagic), b[:len(indexMagic)])
+	require.Len(t, b, indexHeaderWidth+4*entryWidth)
+
+	// Indexes of an unknown version aren't read
+	b[len(indexMagic)] = indexVersion1 + 1
+	require.NoError(t, os.WriteFile(name, b, 0644))
+	f, err = os.OpenFile(name, os.O_RDWR, 0644)
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = newIndex(f, c)
+	require.Error(t, err)
+}
@@ -0,0 +1,113 @@
+package log
+
+import (
+	"errors"
+	"io"
+
+	v1 "github.com/adityavit/proglog/api/v1"
+)
+
+// Iterator reads the records of a log in order across segments:
+//
+//	it := log.Iterator(from)
+//	defer it.Close()
+//	for it.Next() {
+//		record := it.Record()
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+//
+// Offsets compacted away are skipped. An iterator is not safe for concurrent
+// use, but the log can be appended to and truncated while it's open.
+type Iterator struct {
+	log    *Log
+	next   uint64
+	buf    []*v1.Record
+	record *v1.Record
+	err    error
+	// waitErr is why the last NextContext gave up waiting
+	waitErr error
+	closed  bool
+}
+
+// Iterator returns an iterator over the records from the offset on
+func (l *Log) Iterator(from uint64) *Iterator {
+	return &Iterator{log: l, next: from}
+}
+
+// Next advances to the next record and reports whether there is one. It
+// returns false at the end of the log, when the iterator is closed and on
+// errors, which Err returns. Calling Next again after reaching the end picks
+// up the records appended since.
+func (it *Iterator) Next() bool {
+	it.waitErr = nil
+	if it.closed || it.err != nil {
+		return false
+	}
+	if len(it.buf) == 0 {
+		if it.err = it.fill(); it.err != nil || len(it.buf) == 0 {
+			it.record = nil
+			return false
+		}
+	}
+	it.record, it.buf = it.buf[0], it.buf[1:]
+	it.next = it.record.Offset + 1
+	return true
+}
+
+// fill buffers the records of the frame holding the next offset, it buffers
+// nothing at the end of the log
+func (it *Iterator) fill() error {
+	l := it.log
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return ErrLogClosed
+	}
+	if err := l.checkLowest(it.next); err != nil {
+		return err
+	}
+	for _, s := range l.segmentsFrom(it.next) {
+		records, err := s.readFrom(max(it.next, s.baseOffset))
+		if errors.Is(err, io.EOF) {
+			// The rest of the segment was compacted away, the iterator moves
+			// past it so tailing waits for the offsets after it
+			it.next = max(it.next, s.nextOffset)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		it.buf = records
+		return nil
+	}
+	return nil
+}
+
+// Record returns the record Next advanced to
+func (it *Iterator) Record() *v1.Record {
+	return it.record
+}
+
+// Offset returns the offset the iterator continues from
+func (it *Iterator) Offset() uint64 {
+	return it.next
+}
+
+// Err returns the error that stopped the iterator, or the context error when
+// NextContext gave up waiting
+func (it *Iterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.waitErr
+}
+
+// Close stops the iterator, Next returns false from then on
+func (it *Iterator) Close() error {
+	it.closed = true
+	it.buf = nil
+	it.record = nil
+	return nil
+}
@@ -0,0 +1,115 @@
+package log
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	v1 "github.com/adityavit/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// newIteratorLog opens a test log holding n records over segments of 64
+// bytes unless the config asks for others
+func newIteratorLog(t *testing.T, config Config, n int) *Log {
+	if config.Segment.MaxStoreBytes == 0 {
+		config.Segment.MaxStoreBytes = 64
+	}
+	config.Segment.MaxIndexBytes = 1024
+	log := newTestLog(t, config)
+	t.Cleanup(func() { log.Close() })
+	for i := 0; i < n; i++ {
+		_, err := log.Append(&v1.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	return log
+}
+
+func iterate(t *testing.T, it *Iterator) []uint64 {
+	var offsets []uint64
+	for it.Next() {
+		require.Equal(t, []byte(fmt.Sprintf("record %d", it.Record().Offset)), it.Record().Value)
+		offsets = append(offsets, it.Record().Offset)
+	}
+	require.NoError(t, it.Err())
+	return offsets
+}
+
+func TestIterator(t *testing.T) {
+	log := newIteratorLog(t, Config{}, 10)
+	require.Greater(t, len(log.segments), 1)
+
+	it := log.Iterator(0)
+	defer it.Close()
+	require.Equal(t, []uint64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, iterate(t, it))
+
+	// Records appended after the end was reached are picked up
+	_, err := log.Append(&v1.Record{Value: []byte("record 10")})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{10}, iterate(t, it))
+
+	require.Equal(t, []uint64{7, 8, 9, 10}, iterate(t, log.Iterator(7)))
+	require.Empty(t, iterate(t, log.Iterator(11)))
+
+	require.NoError(t, it.Close())
+	_, err = log.Append(&v1.Record{Value: []byte("record 11")})
+	require.NoError(t, err)
+	require.False(t, it.Next())
+	require.NoError(t, it.Err())
+}
+
+func TestIteratorBatchFrames(t *testing.T) {
+	config := Config{}
+	config.Compression.Codec = Gzip
+	config.Compression.PerBatch = true
+	config.Segment.MaxStoreBytes = 1024
+	log := newIteratorLog(t, config, 0)
+	var batch []*v1.Record
+	for i := 0; i < 5; i++ {
+		batch = append(batch, &v1.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+	}
+	_, err := log.AppendBatch(batch)
+	require.NoError(t, err)
+
+	require.Equal(t, []uint64{2, 3, 4}, iterate(t, log.Iterator(2)))
+}
+
+func TestIteratorTruncated(t *testing.T) {
+	log := newIteratorLog(t, Config{}, 10)
+	it := log.Iterator(0)
+	defer it.Close()
+	require.True(t, it.Next())
+
+	require.NoError(t, log.Truncate(5))
+	for it.Next() {
+	}
+	var truncated *ErrOffsetTruncated
+	require.ErrorAs(t, it.Err(), &truncated)
+	require.Equal(t, uint64(5), truncated.Start)
+}
+
+func TestIteratorConcurrentAppends(t *testing.T) {
+	log := newIteratorLog(t, Config{}, 0)
+	const records = 100
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < records; i++ {
+			_, err := log.Append(&v1.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+			require.NoError(t, err)
+		}
+	}()
+
+	// Every record is seen exactly once and in order
+	it := log.Iterator(0)
+	defer it.Close()
+	var offsets []uint64
+	for len(offsets) < records {
+		offsets = append(offsets, iterate(t, it)...)
+	}
+	wg.Wait()
+	for i, off := range offsets {
+		require.Equal(t, uint64(i), off)
+	}
+}
@@ -0,0 +1,49 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// lockFile is held by the process that has the log open, a second NewLog on
+// the same directory fails instead of corrupting the segments
+const lockFile = "proglog.lock"
+
+// dirLock is an advisory lock on a log directory
+type dirLock struct {
+	file *os.File
+}
+
+// lockDir takes the lock of the log in dir, it fails with ErrLogLocked right
+// away when another process or Log holds it
+func lockDir(dir string) (*dirLock, error) {
+	path := filepath.Join(dir, lockFile)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := flock(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%w: %s: %v", ErrLogLocked, dir, err)
+	}
+	// The pid is only there to tell who holds it
+	if err := f.Truncate(0); err == nil {
+		fmt.Fprintf(f, "%d\n", os.Getpid())
+	}
+	return &dirLock{file: f}, nil
+}
+
+// release drops the lock, the file is left behind since removing it would
+// race with another process taking it
+func (d *dirLock) release() error {
+	if d == nil || d.file == nil {
+		return nil
+	}
+	err := funlock(d.file)
+	if cerr := d.file.Close(); err == nil {
+		err = cerr
+	}
+	d.file = nil
+	return err
+}
@@ -0,0 +1,16 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package log
+
+import "os"
+
+// The directory isn't locked where flock isn't available, the lock file is
+// still written so the layout is the same everywhere
+
+func flock(f *os.File) error {
+	return nil
+}
+
+func funlock(f *os.File) error {
+	return nil
+}
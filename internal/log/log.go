@@ -1,16 +1,21 @@
 package log
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	v1 "github.com/adityavit/proglog/api/v1"
+	"google.golang.org/protobuf/proto"
 )
 
 type Log struct {
@@ -19,14 +24,45 @@ type Log struct {
 	mu            sync.RWMutex
 	segments      []*Segment
 	activeSegment *Segment
+	syncer        *syncer
+	committer     *committer
+	retention     *loop
+	compaction    *loop
+	refresher     *loop
+	// compactMu keeps compactions from running concurrently
+	compactMu sync.Mutex
+	// truncations counts the calls to TruncateAfter, a compaction that
+	// started before one is thrown away
+	truncations uint64
+	// startOffset is the offset Truncate last cut the log at, it's
+	// checkpointed in startOffsetFile
+	startOffset uint64
+	closed      bool
+	// lock keeps other processes from opening the directory
+	lock *dirLock
 }
 
 func NewLog(dir string, c Config) (*Log, error) {
 	if c.Segment.MaxStoreBytes == 0 {
-		c.Segment.MaxStoreBytes = 1024
+		c.Segment.MaxStoreBytes = defaultMaxStoreBytes
 	}
 	if c.Segment.MaxIndexBytes == 0 {
-		c.Segment.MaxIndexBytes = 1024
+		c.Segment.MaxIndexBytes = defaultMaxIndexBytes
+	}
+	if c.Durability.Sync == SyncPeriodic && c.Durability.SyncInterval == 0 {
+		c.Durability.SyncInterval = defaultSyncInterval
+	}
+	if c.Retention.CheckInterval == 0 {
+		c.Retention.CheckInterval = defaultRetentionCheckInterval
+	}
+	if c.Compaction.DeleteRetention == 0 {
+		c.Compaction.DeleteRetention = defaultDeleteRetention
+	}
+	if c.Compaction.CheckInterval == 0 {
+		c.Compaction.CheckInterval = defaultCompactionCheckInterval
+	}
+	if c.ReadOnly.RefreshInterval == 0 {
+		c.ReadOnly.RefreshInterval = defaultRefreshInterval
 	}
 	l := &Log{
 		Dir:    dir,
@@ -38,32 +74,32 @@ func NewLog(dir string, c Config) (*Log, error) {
 	return l, nil
 }
 
-func (l *Log) setup() error {
-	files, err := os.ReadDir(l.Dir)
-	if err != nil {
+func (l *Log) setup() (err error) {
+	if l.Config.ReadOnly.Enabled {
+		return l.setupReadOnly()
+	}
+	if l.lock, err = lockDir(l.Dir); err != nil {
 		return err
 	}
-	var baseOffsets []uint64
-	for _, file := range files {
-		offStr := strings.TrimSuffix(file.Name(), filepath.Ext(file.Name()))
-		off, err := strconv.ParseUint(offStr, 10, 0)
+	defer func() {
 		if err != nil {
-			return err
+			l.lock.release()
 		}
-		baseOffsets = append(baseOffsets, off)
+	}()
+	if err := l.checkMetadata(); err != nil {
+		return err
+	}
+	if l.startOffset, err = readStartOffset(l.Dir); err != nil {
+		return err
+	}
+	baseOffsets, err := l.scanSegments()
+	if err != nil {
+		return err
 	}
-	sort.Slice(baseOffsets, func(i, j int) bool {
-		return baseOffsets[i] < baseOffsets[j]
-	})
 	// Create segments
 	l.segments = make([]*Segment, 0)
-	for i := 0; i < len(baseOffsets); i++ {
-		// There is two offsets with same value, one of them is the index and the other is the store
-		// We only need one of them
-		if i > 0 && baseOffsets[i] == baseOffsets[i-1] {
-			continue
-		}
-		if err := l.newSegment(baseOffsets[i]); err != nil {
+	for _, baseOffset := range baseOffsets {
+		if err := l.newSegment(baseOffset); err != nil {
 			return err
 		}
 	}
@@ -73,9 +109,140 @@ func (l *Log) setup() error {
 			return err
 		}
 	}
+	// Only the active segment is appended to, so only its tail can be torn
+	for _, s := range l.segments {
+		if s != l.activeSegment {
+			if err := s.Seal(); err != nil {
+				return err
+			}
+		}
+		if err := l.recoverSegment(s); err != nil {
+			return err
+		}
+	}
+	l.syncer = newSyncer(l)
+	if l.Config.GroupCommit.Enabled {
+		l.committer = newCommitter(l)
+	}
+	l.retention = startRetention(l)
+	l.compaction = startCompaction(l)
+	return nil
+}
+
+// setupReadOnly opens the segments of a log read-only, it neither locks the
+// directory nor repairs segments, a torn tail is left out instead
+func (l *Log) setupReadOnly() error {
+	if err := l.checkMetadata(); err != nil {
+		return err
+	}
+	if err := l.refresh(); err != nil {
+		return err
+	}
+	l.syncer = newSyncer(l)
+	l.refresher = startRefresh(l)
 	return nil
 }
 
+// scanSegments returns the sorted base offsets of the segments in the
+// directory. Leftovers of an interrupted compaction or index migration are
+// removed, index files without a store are renamed out of the way and files
+// that aren't the log's are left alone. A read-only log leaves them all.
+func (l *Log) scanSegments() ([]uint64, error) {
+	files, err := os.ReadDir(l.Dir)
+	if err != nil {
+		return nil, err
+	}
+	stores := make(map[uint64]bool)
+	indexes := make(map[uint64][]string)
+	for _, file := range files {
+		name := file.Name()
+		ext := filepath.Ext(name)
+		switch {
+		case name == lockFile,
+			strings.HasPrefix(name, metadataFile),
+			strings.HasPrefix(name, startOffsetFile),
+			ext == orphanedExt:
+			continue
+		case ext == cleanedExt || ext == migratingExt:
+			if l.Config.ReadOnly.Enabled {
+				continue
+			}
+			// A compacted store that was never swapped in, the segment
+			// still has its old one, or an index that was never migrated
+			if err := os.Remove(filepath.Join(l.Dir, name)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		off, err := strconv.ParseUint(strings.TrimSuffix(name, ext), 10, 64)
+		known := ext == storeExt || ext == indexExt || ext == timeIndexExt
+		if err != nil || !known || !file.Type().IsRegular() {
+			slog.Warn("ignoring unknown file in log directory", "dir", l.Dir, "file", name)
+			continue
+		}
+		if ext == storeExt {
+			stores[off] = true
+		} else {
+			indexes[off] = append(indexes[off], name)
+		}
+	}
+	// The records of an index without a store are gone, opening it would
+	// create an empty store the index points past
+	for off, names := range indexes {
+		if stores[off] || l.Config.ReadOnly.Enabled {
+			continue
+		}
+		for _, name := range names {
+			path := filepath.Join(l.Dir, name)
+			if err := os.Rename(path, path+orphanedExt); err != nil {
+				return nil, err
+			}
+		}
+		slog.Warn("quarantined index files without a store", "dir", l.Dir, "segment", off, "files", names)
+	}
+	baseOffsets := make([]uint64, 0, len(stores))
+	for off := range stores {
+		baseOffsets = append(baseOffsets, off)
+	}
+	sort.Slice(baseOffsets, func(i, j int) bool {
+		return baseOffsets[i] < baseOffsets[j]
+	})
+	return baseOffsets, nil
+}
+
+// recoverSegment repairs a segment left behind by a crash, the index of every
+// segment that wasn't closed cleanly is still truncated to MaxIndexBytes
+func (l *Log) recoverSegment(s *Segment) error {
+	r, err := s.recover(s == l.activeSegment)
+	if err != nil {
+		return fmt.Errorf("recovering segment %d: %w", s.baseOffset, err)
+	}
+	if r.repaired() {
+		slog.Warn("repaired segment",
+			"dir", l.Dir,
+			"segment", s.baseOffset,
+			"rebuiltIndex", r.rebuilt,
+			"droppedIndexEntries", r.droppedEntries,
+			"indexedRecords", r.indexedRecords,
+			"truncatedBytes", r.truncatedBytes,
+			"nextOffset", s.nextOffset,
+		)
+	}
+	l.logCorrupt(s, r)
+	return nil
+}
+
+// logCorrupt reports the damaged records recovery skipped in the segment
+func (l *Log) logCorrupt(s *Segment, r recovery) {
+	if r.corruptBytes > 0 {
+		slog.Error("segment has corrupt records",
+			"dir", l.Dir,
+			"segment", s.baseOffset,
+			"corruptBytes", r.corruptBytes,
+		)
+	}
+}
+
 // Create a new segment
 func (l *Log) newSegment(baseOffset uint64) error {
 	// fmt.Printf("Creating new segment at %v with base offset %v", l.Dir, baseOffset)
@@ -89,47 +256,240 @@ func (l *Log) newSegment(baseOffset uint64) error {
 	return nil
 }
 
-// Append a record to the log
+// Append a record to the log, it returns once the record is as durable as
+// Config.Durability asks for
 func (l *Log) Append(record *v1.Record) (uint64, error) {
+	if err := l.checkWritable(); err != nil {
+		return 0, err
+	}
+	if err := l.checkSize(record); err != nil {
+		return 0, err
+	}
+	var offset uint64
+	var err error
+	if l.committer != nil {
+		offset, err = l.committer.append(record)
+	} else {
+		l.mu.Lock()
+		if l.closed {
+			err = ErrLogClosed
+		} else {
+			offset, _, err = l.appendRecords([]*v1.Record{record})
+		}
+		l.mu.Unlock()
+	}
+	if err != nil {
+		return offset, err
+	}
+	return offset, l.syncer.durable.wait(context.Background(), offset)
+}
+
+// AppendBatch appends the records with contiguous offsets and returns the
+// offset of the first one. Either all of the records are appended or none of
+// them, even across a crash, so a batch that doesn't fit in the active
+// segment goes into a new one.
+func (l *Log) AppendBatch(records []*v1.Record) (uint64, error) {
+	if err := l.checkWritable(); err != nil {
+		return 0, err
+	}
+	if len(records) == 0 {
+		return 0, errors.New("empty batch")
+	}
+	if err := l.checkSize(records...); err != nil {
+		return 0, err
+	}
 	l.mu.Lock()
-	defer l.mu.Unlock()
-	offset, err := l.activeSegment.Append(record)
+	first, err := l.appendBatch(records)
+	l.mu.Unlock()
 	if err != nil {
 		return 0, err
 	}
+	return first, l.syncer.durable.wait(context.Background(), first+uint64(len(records))-1)
+}
+
+// checkSize returns ErrRecordTooLarge for records larger than MaxRecordBytes.
+// Records are sized before the log sets their offset and timestamp.
+func (l *Log) checkSize(records ...*v1.Record) error {
+	limit := l.Config.Segment.MaxRecordBytes
+	if limit == 0 {
+		return nil
+	}
+	for _, record := range records {
+		if size := uint64(proto.Size(record)); size > limit {
+			return fmt.Errorf("record of %d bytes is larger than %d bytes: %w", size, limit, ErrRecordTooLarge)
+		}
+	}
+	return nil
+}
+
+// appendBatch writes the batch to the active segment, the caller must hold the
+// lock
+func (l *Log) appendBatch(records []*v1.Record) (uint64, error) {
+	if l.closed {
+		return 0, ErrLogClosed
+	}
 	if l.activeSegment.IsMaxed() {
-		err = l.newSegment(l.activeSegment.nextOffset)
+		if err := l.roll(); err != nil {
+			return 0, err
+		}
+	}
+	first, err := l.activeSegment.AppendBatch(records)
+	if errors.Is(err, ErrSegmentFull) && l.activeSegment.nextOffset != l.activeSegment.baseOffset {
+		// A batch that doesn't fit in any segment leaves the log as it was
+		fits, ferr := l.activeSegment.fitsEmpty(records)
+		if ferr != nil {
+			return 0, ferr
+		}
+		if fits {
+			if err := l.roll(); err != nil {
+				return 0, err
+			}
+			first, err = l.activeSegment.AppendBatch(records)
+		}
+	}
+	if errors.Is(err, ErrSegmentFull) {
+		return 0, fmt.Errorf("batch of %d records does not fit in a segment: %w", len(records), err)
 	}
-	return offset, err
+	if err != nil {
+		return 0, err
+	}
+	// A maxed out segment is rolled by the next append, so the batch is never
+	// reported as failed once it was written
+	return first, l.syncer.appended(uint64(len(records)))
 }
 
+// appendRecords writes the records to the log with contiguous offsets, rolling
+// the active segment as it fills up. It returns the offset of the first record
+// and how many were written, the caller must hold the lock.
+func (l *Log) appendRecords(records []*v1.Record) (first uint64, n int, err error) {
+	first = l.activeSegment.nextOffset
+	for n < len(records) {
+		if l.activeSegment.IsMaxed() {
+			if err := l.roll(); err != nil {
+				return first, n, err
+			}
+		}
+		written, err := l.activeSegment.appendUpTo(records[n:])
+		if err != nil {
+			return first, n, err
+		}
+		if written == 0 {
+			// A record that doesn't fit in any segment leaves the log as it
+			// was, the active segment isn't rolled for it
+			fits := l.activeSegment.nextOffset != l.activeSegment.baseOffset
+			if fits {
+				if fits, err = l.activeSegment.fitsEmpty(records[n : n+1]); err != nil {
+					return first, n, err
+				}
+			}
+			if !fits {
+				return first, n, fmt.Errorf("record does not fit in an empty segment: %w", ErrRecordTooLarge)
+			}
+			if err := l.roll(); err != nil {
+				return first, n, err
+			}
+			continue
+		}
+		n += written
+		if err := l.syncer.appended(uint64(written)); err != nil {
+			return first, n, err
+		}
+	}
+	if l.activeSegment.IsMaxed() {
+		err = l.roll()
+	}
+	return first, n, err
+}
+
+// roll replaces the active segment with a new one starting at its next offset
+func (l *Log) roll() error {
+	// Records still waiting for a periodic sync must not be left behind
+	if err := l.syncer.sync(); err != nil {
+		return err
+	}
+	if err := l.activeSegment.Seal(); err != nil {
+		return err
+	}
+	return l.newSegment(l.activeSegment.nextOffset)
+}
+
+// Read returns the record at the offset. Compaction leaves gaps in the
+// offsets, reading an offset that was compacted away returns the next record
+// after it, so consumers should carry on from the offset of the record they
+// got.
 func (l *Log) Read(offset uint64) (*v1.Record, error) {
+	record := &v1.Record{}
+	if err := l.ReadInto(offset, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// ReadInto is Read into a record the caller provides, which saves allocating
+// a record for every read
+func (l *Log) ReadInto(offset uint64, record *v1.Record) error {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
-	var segment *Segment
-	// Binary search can be used to find the segment
-	for _, s := range l.segments {
-		if s.baseOffset <= offset && offset < s.nextOffset {
-			segment = s
-			break
+	if l.closed {
+		return ErrLogClosed
+	}
+	if err := l.checkLowest(offset); err != nil {
+		return err
+	}
+	for _, s := range l.segmentsFrom(offset) {
+		err := s.ReadInto(max(offset, s.baseOffset), record)
+		if errors.Is(err, io.EOF) {
+			// The rest of the segment was compacted away
+			continue
 		}
+		return err
 	}
-	if segment == nil || segment.nextOffset <= offset {
-		return nil, fmt.Errorf("offset %d not found and is out of range", offset)
+	return fmt.Errorf("reading offset %d: %w", offset, ErrOffsetOutOfRange)
+}
+
+// segmentsFrom returns the segment holding the offset and the ones after it,
+// or none when the offset is below the start of the log. The caller must hold
+// the lock.
+func (l *Log) segmentsFrom(offset uint64) []*Segment {
+	if offset < l.lowestOffset() {
+		return nil
 	}
-	return segment.Read(offset)
+	// Segments are sorted by offset and don't overlap
+	i := sort.Search(len(l.segments), func(i int) bool {
+		return offset < l.segments[i].nextOffset
+	})
+	return l.segments[i:]
 }
 
 func (l *Log) Close() error {
+	if l.committer != nil {
+		l.committer.close()
+	}
+	l.retention.close()
+	l.compaction.close()
+	l.refresher.close()
+	l.syncer.close()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	if err := l.syncer.sync(); err != nil {
+		return err
+	}
+	// Wake up whoever is still waiting for records
+	l.syncer.durable.fail(ErrLogClosed)
 	for _, segment := range l.segments {
 		if err := segment.Close(); err != nil {
+			l.lock.release()
 			return err
 		}
 	}
-	return nil
+	return l.lock.release()
 }
 
 func (l *Log) Remove() error {
+	if err := l.checkWritable(); err != nil {
+		return err
+	}
 	if err := l.Close(); err != nil {
 		return err
 	}
@@ -137,17 +497,60 @@ func (l *Log) Remove() error {
 }
 
 func (l *Log) Reset() error {
+	if err := l.checkWritable(); err != nil {
+		return err
+	}
 	if err := l.Remove(); err != nil {
 		return err
 	}
+	l.closed = false
 	return l.setup()
 }
 
+// OffsetForTime returns the offset of the first record with a timestamp at or
+// after t, records below the start of the log are left out
+func (l *Log) OffsetForTime(t time.Time) (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	timestamp := t.UnixMilli()
+	lowest := l.lowestOffset()
+	for _, s := range l.segments {
+		if off, ok := s.OffsetForTime(timestamp); ok {
+			return max(off, lowest), nil
+		}
+	}
+	return 0, fmt.Errorf("no record at or after %s: %w", t.Format(time.RFC3339Nano), ErrOffsetOutOfRange)
+}
+
+// RebuildIndex regenerates the index of every segment from its store file
+func (l *Log) RebuildIndex() error {
+	if err := l.checkWritable(); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, s := range l.segments {
+		// Only the active segment can have a torn tail to cut off
+		r, err := s.rebuildIndex(s == l.activeSegment)
+		if err != nil {
+			return fmt.Errorf("rebuilding index of segment %d: %w", s.baseOffset, err)
+		}
+		slog.Info("rebuilt segment index",
+			"dir", l.Dir,
+			"segment", s.baseOffset,
+			"indexedRecords", r.indexedRecords,
+			"truncatedBytes", r.truncatedBytes,
+			"nextOffset", s.nextOffset,
+		)
+		l.logCorrupt(s, r)
+	}
+	return nil
+}
+
 func (l *Log) LowestOffset() (uint64, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
-	// fmt.Printf("segments: %v\n", l.segments)
-	return l.segments[0].baseOffset, nil
+	return l.lowestOffset(), nil
 }
 
 func (l *Log) HighestOffset() (uint64, error) {
@@ -160,12 +563,30 @@ func (l *Log) HighestOffset() (uint64, error) {
 	return offset - 1, nil
 }
 
+// Truncate removes the records below lowest, which becomes the lowest offset
+// of the log. Reading a record below it returns an ErrOffsetTruncated, even
+// when it's still in the first segment.
 func (l *Log) Truncate(lowest uint64) error {
+	if err := l.checkWritable(); err != nil {
+		return err
+	}
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if next := l.activeSegment.nextOffset; lowest > next {
+		return fmt.Errorf("truncating to offset %d past the end of the log at %d", lowest, next)
+	}
+	if lowest <= l.lowestOffset() {
+		return nil
+	}
+	// The checkpoint goes first, a crash before the segments are removed
+	// leaves records that can't be read rather than records read again
+	if err := writeStartOffset(l.Dir, lowest); err != nil {
+		return fmt.Errorf("checkpointing log start offset %d: %w", lowest, err)
+	}
+	l.startOffset = lowest
 	var segments []*Segment
 	for _, s := range l.segments {
-		if s.nextOffset <= lowest+1 {
+		if s.nextOffset <= lowest && s != l.activeSegment {
 			if err := s.Remove(); err != nil {
 				return err
 			}
@@ -177,26 +598,144 @@ func (l *Log) Truncate(lowest uint64) error {
 	return nil
 }
 
+// TruncateAfter removes every record after the offset, the next record
+// appended gets the offset after it. It's meant for rolling back records that
+// were never committed, such as a diverged follower in a replicated log:
+// iterators may already have buffered the removed records and appends still
+// waiting for their records to become durable may see later records take
+// their offsets.
+func (l *Log) TruncateAfter(offset uint64) error {
+	if err := l.checkWritable(); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.truncations++
+	// The offsets up to the one truncated after were handed out already,
+	// even when compaction removed their records
+	next := min(offset+1, l.activeSegment.nextOffset)
+	// Newest first, so a crash half way leaves a log without holes
+	for len(l.segments) > 0 {
+		s := l.segments[len(l.segments)-1]
+		if s.baseOffset <= offset {
+			break
+		}
+		if err := s.Remove(); err != nil {
+			return err
+		}
+		l.segments = l.segments[:len(l.segments)-1]
+	}
+	if len(l.segments) == 0 {
+		if err := l.newSegment(offset + 1); err != nil {
+			return err
+		}
+	} else {
+		s := l.segments[len(l.segments)-1]
+		if err := s.TruncateAfter(offset); err != nil {
+			return fmt.Errorf("truncating segment %d after offset %d: %w", s.baseOffset, offset, err)
+		}
+		// The segment may have been sealed
+		if err := s.store.Unseal(); err != nil {
+			return err
+		}
+		l.activeSegment = s
+		if s.nextOffset < next {
+			// The segment's records end before them, an empty segment
+			// starting after them keeps them from being handed out again,
+			// across a restart too
+			s.nextOffset = next
+			if err := l.roll(); err != nil {
+				return err
+			}
+		}
+	}
+	// The next record appended must stay readable
+	if l.startOffset > offset+1 {
+		if err := writeStartOffset(l.Dir, offset+1); err != nil {
+			return fmt.Errorf("checkpointing log start offset %d: %w", offset+1, err)
+		}
+		l.startOffset = offset + 1
+	}
+	l.syncer.truncated()
+	return nil
+}
+
+// segmentReader reads the frames of a segment, compressed and encrypted
+// frames are read as the plain frames of the records in them
 type segmentReader struct {
-	*store
-	off int64
+	*Segment
+	log *Log
+	off uint64
+	buf []byte
 }
 
+// Reader returns the frames of every segment one after the other, starting
+// with the frame holding the start of the log
 func (l *Log) Reader() io.Reader {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 	readers := make([]io.Reader, len(l.segments))
 	for i, segment := range l.segments {
-		readers[i] = &segmentReader{
-			segment.store,
-			0,
+		r := &segmentReader{
+			Segment: segment,
+			log:     l,
+		}
+		if i == 0 && l.startOffset > segment.baseOffset {
+			// Truncated records are skipped, those sharing a frame with the
+			// start offset are read along with it
+			if pos, err := segment.locate(l.startOffset); err == nil {
+				r.off = pos
+			} else {
+				r.off = segment.store.size
+			}
 		}
+		readers[i] = r
 	}
 	return io.MultiReader(readers...)
 }
 
 func (s *segmentReader) Read(p []byte) (int, error) {
-	n, err := s.ReadAt(p, s.off)
-	s.off += int64(n)
-	return n, err
+	if len(s.buf) == 0 {
+		if err := s.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+// fill buffers the frame at off, it returns io.EOF at the end of the store
+func (s *segmentReader) fill() error {
+	// The segment can't be closed while it's read, nor appended to
+	s.log.mu.RLock()
+	defer s.log.mu.RUnlock()
+	if s.log.closed {
+		return ErrLogClosed
+	}
+	if s.off >= s.store.size {
+		return io.EOF
+	}
+	f, err := s.store.ReadFrame(s.off)
+	if err != nil {
+		return err
+	}
+	if f.flags&(frameCodecMask|frameFlagBatch|frameFlagEncrypted) == 0 {
+		s.buf = make([]byte, f.width)
+		if _, err := s.store.ReadAt(s.buf, int64(s.off)); err != nil {
+			return err
+		}
+		s.off += f.width
+		return nil
+	}
+	payloads, err := s.decodeFrame(s.off, f)
+	if err != nil {
+		return err
+	}
+	for _, p := range payloads {
+		s.buf = append(s.buf, encodeFrameHeader(0, p)...)
+		s.buf = append(s.buf, p...)
+	}
+	s.off += f.width
+	return nil
 }
@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	v1 "github.com/adityavit/proglog/api/v1"
 	"github.com/stretchr/testify/require"
@@ -14,25 +16,44 @@ import (
 func TestLog(t *testing.T) {
 	for scenario, fn := range map[string]func(t *testing.T, log *Log){
 		// "append and read a record succeeds": testAppendRead,
-		// "offset out of range error":         testOutOfRange,
 		// "init with existing segments":       testInitWithExistingSegment,
 		// "reader":                            testReader,
-		"truncate": testTruncate,
+		"truncate":                    testTruncate,
+		"recover torn tail on reopen": testRecoverTornTail,
+		"rebuild index":               testRebuildIndex,
+		"append batch":                testAppendBatch,
+		"read into reused record":     testReadInto,
+		"truncate after":              testTruncateAfter,
+		"offset out of range error":   testOutOfRange,
+		"closed log":                  testClosed,
+		"record too large":            testRecordTooLarge,
+		"locked directory":            testLocked,
+		"stray files":                 testStrayFiles,
+		"metadata":                    testMetadata,
+		"read only":                   testReadOnly,
 	} {
 		t.Run(scenario, func(t *testing.T) {
-			dir, err := os.MkdirTemp("/tmp", "log-test")
-			require.NoError(t, err)
-			defer os.RemoveAll(dir)
 			config := Config{}
 			config.Segment.InitialOffset = 0
-			config.Segment.MaxStoreBytes = 32
-			log, err := NewLog(dir, config)
-			require.NoError(t, err)
-			fn(t, log)
+			config.Segment.MaxIndexBytes = 1024
+			config.Segment.MaxStoreBytes = 64
+			fn(t, newTestLog(t, config))
 		})
 	}
 }
 
+// newTestLog opens a log in a temporary directory, which is removed when the
+// test is done
+func newTestLog(t *testing.T, config Config) *Log {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "log-test")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	log, err := NewLog(dir, config)
+	require.NoError(t, err)
+	return log
+}
+
 func testAppendRead(t *testing.T, log *Log) {
 	wantRecord := &v1.Record{
 		Value: []byte("hello world"),
@@ -59,12 +80,345 @@ func testAppendRead(t *testing.T, log *Log) {
 	require.Equal(t, wantRecord2.Value, read.Value)
 }
 
+func TestLogCorruptRecord(t *testing.T) {
+	config := Config{}
+	config.Segment.MaxIndexBytes = 4 * entryWidth
+	log := newTestLog(t, config)
+	for i := 0; i < 10; i++ {
+		_, err := log.Append(&v1.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.Len(t, log.segments, 3)
+	sizes := make([]uint64, len(log.segments))
+	for i, s := range log.segments {
+		sizes[i] = s.store.size
+	}
+	// Flip a bit in record 0 of a sealed segment and in record 8, the first
+	// of the active one, both have intact records after them
+	names := []string{log.segments[0].store.Name(), log.activeSegment.store.Name()}
+	require.NoError(t, log.Close())
+	for _, name := range names {
+		b, err := os.ReadFile(name)
+		require.NoError(t, err)
+		b[frameHeaderWidth+2] ^= 0x10
+		require.NoError(t, os.WriteFile(name, b, 0644))
+	}
+
+	log, err := NewLog(log.Dir, config)
+	require.NoError(t, err)
+	defer log.Close()
+	for i, s := range log.segments {
+		require.Equal(t, sizes[i], s.store.size)
+	}
+	for off := uint64(0); off < 10; off++ {
+		read, err := log.Read(off)
+		if off == 0 || off == 8 {
+			var corrupt *ErrCorruptRecord
+			require.ErrorAs(t, err, &corrupt)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("record %d", off), string(read.Value))
+	}
+	off, err := log.Append(&v1.Record{Value: []byte("record 10")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), off)
+}
+
+func TestLogRebuildIndexCorruptRecord(t *testing.T) {
+	config := Config{}
+	config.Segment.MaxIndexBytes = 4 * entryWidth
+	log := newTestLog(t, config)
+	for i := 0; i < 12; i++ {
+		_, err := log.Append(&v1.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	middle := log.segments[1]
+	size := middle.store.size
+	// Damage records 5 and 7, in the middle and at the end of a sealed
+	// segment
+	b, err := os.ReadFile(middle.store.Name())
+	require.NoError(t, err)
+	for _, n := range []int64{1, 3} {
+		_, pos, err := middle.index.Read(n)
+		require.NoError(t, err)
+		b[pos+frameHeaderWidth+2] ^= 0x10
+	}
+	require.NoError(t, os.WriteFile(middle.store.Name(), b, 0644))
+
+	check := func(log *Log) {
+		t.Helper()
+		require.Equal(t, size, log.segments[1].store.size)
+		for off := uint64(0); off < 12; off++ {
+			read, err := log.Read(off)
+			if off == 5 || off == 7 {
+				var corrupt *ErrCorruptRecord
+				require.ErrorAs(t, err, &corrupt)
+				continue
+			}
+			require.NoError(t, err)
+			require.Equal(t, fmt.Sprintf("record %d", off), string(read.Value))
+		}
+	}
+	// The records after the damaged one stay when the index is rebuilt
+	require.NoError(t, log.RebuildIndex())
+	check(log)
+
+	// And when it's rebuilt because it's missing
+	require.NoError(t, log.Close())
+	require.NoError(t, os.Remove(middle.index.Name()))
+	log, err = NewLog(log.Dir, config)
+	require.NoError(t, err)
+	defer log.Close()
+	check(log)
+}
+
+func TestLogReaderDuringAppend(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-reader-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	config := Config{}
+	// The reader stays on the active segment
+	config.Segment.MaxIndexBytes = 1 << 20
+	config.Segment.MaxStoreBytes = 1 << 20
+	log, err := NewLog(dir, config)
+	require.NoError(t, err)
+	defer log.Close()
+
+	_, err = log.Append(&v1.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				log.Append(&v1.Record{Value: []byte("hello world")})
+			}
+		}
+	}()
+	// Pausing between reads lets appends land right before the reader
+	// checks for the end of the store
+	r := log.Reader()
+	p := make([]byte, 1024)
+	for i := 0; i < 20; i++ {
+		_, err := r.Read(p)
+		if err == io.EOF {
+			r = log.Reader()
+			continue
+		}
+		require.NoError(t, err)
+		time.Sleep(100 * time.Microsecond)
+	}
+	close(stop)
+	<-done
+}
+
 func testOutOfRange(t *testing.T, log *Log) {
 	read, err := log.Read(2)
-	require.Error(t, err)
+	require.ErrorIs(t, err, ErrOffsetOutOfRange)
 	require.Nil(t, read)
 }
 
+func testRecordTooLarge(t *testing.T, log *Log) {
+	// A record that doesn't fit in an empty segment never oversizes one
+	_, err := log.Append(&v1.Record{Value: make([]byte, 100)})
+	require.ErrorIs(t, err, ErrRecordTooLarge)
+	require.Len(t, log.segments, 1)
+	require.Equal(t, uint64(0), log.activeSegment.store.size)
+
+	log.Config.Segment.MaxRecordBytes = 8
+	_, err = log.Append(&v1.Record{Value: []byte("hello world")})
+	require.ErrorIs(t, err, ErrRecordTooLarge)
+	_, err = log.AppendBatch([]*v1.Record{{Value: []byte("hello")}, {Value: []byte("hello world")}})
+	require.ErrorIs(t, err, ErrRecordTooLarge)
+	off, err := log.Append(&v1.Record{Value: []byte("hello")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+
+	// Nor does it roll a segment that isn't empty
+	log.Config.Segment.MaxRecordBytes = 0
+	size := log.activeSegment.store.size
+	_, err = log.Append(&v1.Record{Value: make([]byte, 100)})
+	require.ErrorIs(t, err, ErrRecordTooLarge)
+	_, err = log.AppendBatch([]*v1.Record{{Value: make([]byte, 30)}, {Value: make([]byte, 30)}})
+	require.ErrorIs(t, err, ErrSegmentFull)
+	require.Len(t, log.segments, 1)
+	require.Equal(t, size, log.activeSegment.store.size)
+	off, err = log.Append(&v1.Record{Value: []byte("hello")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+}
+
+func testClosed(t *testing.T, log *Log) {
+	_, err := log.Append(&v1.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+
+	_, err = log.Read(0)
+	require.ErrorIs(t, err, ErrLogClosed)
+	_, err = log.Append(&v1.Record{Value: []byte("hello world")})
+	require.ErrorIs(t, err, ErrLogClosed)
+	_, err = log.AppendBatch([]*v1.Record{{Value: []byte("hello world")}})
+	require.ErrorIs(t, err, ErrLogClosed)
+}
+
+func testLocked(t *testing.T, log *Log) {
+	_, err := NewLog(log.Dir, log.Config)
+	require.ErrorIs(t, err, ErrLogLocked)
+
+	// The lock goes away with the log and is ignored by setup
+	require.NoError(t, log.Close())
+	log, err = NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+}
+
+func testStrayFiles(t *testing.T, log *Log) {
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&v1.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+	for _, name := range []string{".DS_Store", "notes.txt", "abc.store", "3.store.tmp", "99.index", "99.timeindex"} {
+		require.NoError(t, os.WriteFile(filepath.Join(log.Dir, name), []byte("stray"), 0644))
+	}
+	require.NoError(t, os.Mkdir(filepath.Join(log.Dir, "1.store.d"), 0755))
+
+	log, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	defer log.Close()
+	off, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	// The index without a store is moved out of the way
+	_, err = os.Stat(filepath.Join(log.Dir, "99.index"+orphanedExt))
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(log.Dir, "99.store"))
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(log.Dir, "notes.txt"))
+	require.NoError(t, err)
+}
+
+func testMetadata(t *testing.T, log *Log) {
+	m, ok, err := readMetadata(log.Dir)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, metadataVersion, m.Version)
+	require.Equal(t, newConfigSnapshot(log.Config), m.Config)
+	require.NoError(t, log.Close())
+
+	// A config change is recorded, the creation time is kept
+	config := log.Config
+	config.Segment.MaxStoreBytes = 128
+	log, err = NewLog(log.Dir, config)
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+	changed, _, err := readMetadata(log.Dir)
+	require.NoError(t, err)
+	require.Equal(t, uint64(128), changed.Config.MaxStoreBytes)
+	require.True(t, m.CreatedAt.Equal(changed.CreatedAt))
+
+	// A log written by a newer version isn't opened
+	changed.Version = metadataVersion + 1
+	require.NoError(t, writeMetadata(log.Dir, changed))
+	_, err = NewLog(log.Dir, config)
+	require.Error(t, err)
+}
+
+func testReadOnly(t *testing.T, log *Log) {
+	wantRecord := &v1.Record{Value: []byte("hello world")}
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(wantRecord)
+		require.NoError(t, err)
+	}
+	// It opens next to the writer
+	config := log.Config
+	config.ReadOnly.Enabled = true
+	config.ReadOnly.RefreshInterval = time.Hour
+	ro, err := NewLog(log.Dir, config)
+	require.NoError(t, err)
+	for off := uint64(0); off < 3; off++ {
+		read, err := ro.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, read.Offset)
+	}
+	_, err = ro.Append(wantRecord)
+	require.ErrorIs(t, err, ErrReadOnly)
+	_, err = ro.AppendBatch([]*v1.Record{wantRecord})
+	require.ErrorIs(t, err, ErrReadOnly)
+	require.ErrorIs(t, ro.Truncate(1), ErrReadOnly)
+	require.ErrorIs(t, ro.TruncateAfter(1), ErrReadOnly)
+	require.ErrorIs(t, ro.Reset(), ErrReadOnly)
+
+	// Records and segments the writer adds show up once it's refreshed
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(wantRecord)
+		require.NoError(t, err)
+	}
+	_, err = ro.Read(5)
+	require.ErrorIs(t, err, ErrOffsetOutOfRange)
+	require.NoError(t, ro.Refresh())
+	read, err := ro.Read(5)
+	require.NoError(t, err)
+	require.Equal(t, wantRecord.Value, read.Value)
+	require.Equal(t, uint64(6), ro.HighWatermark())
+
+	// A partial record is left out, not cut off
+	active := log.activeSegment
+	require.NoError(t, active.store.buf.Flush())
+	_, err = active.store.file.Write([]byte{frameVersion1, 0, 0, 0, 0, 0x20})
+	require.NoError(t, err)
+	require.NoError(t, ro.Refresh())
+	off, err := ro.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+	require.NoError(t, ro.Close())
+
+	store, err := os.Stat(active.store.Name())
+	require.NoError(t, err)
+	require.Equal(t, int64(active.store.size+6), store.Size())
+	index, err := os.Stat(active.index.Name())
+	require.NoError(t, err)
+	require.Equal(t, int64(indexHeaderWidth+log.Config.Segment.MaxIndexBytes), index.Size())
+}
+
+func TestLogReadOnlyTruncateAfter(t *testing.T) {
+	config := Config{}
+	config.Segment.MaxIndexBytes = 512 * entryWidth
+	log := newTestLog(t, config)
+	defer log.Close()
+	for i := 0; i < 600; i++ {
+		_, err := log.Append(&v1.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	config.ReadOnly.Enabled = true
+	config.ReadOnly.RefreshInterval = time.Hour
+	ro, err := NewLog(log.Dir, config)
+	require.NoError(t, err)
+	defer ro.Close()
+
+	// The writer cuts the sealed segment the reader has open by pages, what's
+	// gone can't be read but doesn't crash the reader either
+	require.NoError(t, log.TruncateAfter(10))
+	ro.Read(400)
+	require.NoError(t, ro.Refresh())
+	off, err := ro.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), off)
+	_, err = io.ReadAll(ro.Reader())
+	require.NoError(t, err)
+	for off := uint64(0); off <= 10; off++ {
+		read, err := ro.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("record %d", off), string(read.Value))
+	}
+	_, err = ro.Read(11)
+	require.ErrorIs(t, err, ErrOffsetOutOfRange)
+}
+
 func testInitWithExistingSegment(t *testing.T, log *Log) {
 	wantRecord := &v1.Record{
 		Value: []byte("hello world"),
@@ -126,7 +480,7 @@ func testReader(t *testing.T, log *Log) {
 	b, err := io.ReadAll(reader)
 	require.NoError(t, err)
 	actualRecord := &v1.Record{}
-	err = proto.Unmarshal(b[lenWidth:], actualRecord)
+	err = proto.Unmarshal(b[frameHeaderWidth:], actualRecord)
 	require.NoError(t, err)
 	require.Equal(t, wantRecord.Value, actualRecord.Value)
 }
@@ -147,14 +501,268 @@ func testTruncate(t *testing.T, log *Log) {
 	err = log.Truncate(1)
 	require.NoError(t, err)
 
-	// off, err = log.LowestOffset()
-	// require.NoError(t, err)
-	// require.Equal(t, uint64(1), off)
+	off, err = log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
 
 	off, err = log.HighestOffset()
 	require.NoError(t, err)
 	require.Equal(t, uint64(2), off)
 
 	_, err = log.Read(0)
+	var truncated *ErrOffsetTruncated
+	require.ErrorAs(t, err, &truncated)
+	require.Equal(t, uint64(1), truncated.Start)
+	_, err = log.Read(1)
+	require.NoError(t, err)
+
+	// The start of the log survives a restart
+	require.NoError(t, log.Close())
+	log, err = NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	defer log.Close()
+	off, err = log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	_, err = log.Read(0)
+	require.ErrorAs(t, err, &truncated)
+
+	require.Error(t, log.Truncate(4))
+	require.NoError(t, log.Truncate(0))
+	off, err = log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+}
+
+func testRecoverTornTail(t *testing.T, log *Log) {
+	wantRecord := &v1.Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(wantRecord)
+		require.NoError(t, err)
+	}
+	// Simulate the process dying mid-append without closing the log
+	active := log.activeSegment
+	require.NoError(t, active.store.buf.Flush())
+	_, err := active.store.file.Write([]byte{frameVersion1, 0, 0, 0, 0, 0x20})
+	require.NoError(t, err)
+	// The lock goes away with the process
+	require.NoError(t, log.lock.release())
+
+	log, err = NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	off, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+
+	off, err = log.Append(wantRecord)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	read, err := log.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, wantRecord.Value, read.Value)
+}
+
+func testRebuildIndex(t *testing.T, log *Log) {
+	wantRecord := &v1.Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(wantRecord)
+		require.NoError(t, err)
+	}
+	// Scramble the index of the first segment
+	first := log.segments[0]
+	for i := range first.index.mmap {
+		first.index.mmap[i] = 0xff
+	}
+
+	require.NoError(t, log.RebuildIndex())
+	for off := uint64(0); off < 3; off++ {
+		read, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, read.Offset)
+	}
+}
+
+func testAppendBatch(t *testing.T, log *Log) {
+	off, err := log.Append(&v1.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+
+	// The batch doesn't fit next to the first record, so it goes into a new
+	// segment as a whole
+	batch := []*v1.Record{
+		{Value: []byte("first")},
+		{Value: []byte("second")},
+	}
+	first, err := log.AppendBatch(batch)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), first)
+	require.Len(t, log.segments, 2)
+	require.Equal(t, uint64(1), log.segments[1].baseOffset)
+	for i, want := range batch {
+		read, err := log.Read(first + uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, want.Value, read.Value)
+	}
+
+	// A batch that doesn't fit in an empty segment is rejected
+	huge := make([]*v1.Record, log.Config.Segment.MaxIndexBytes/entryWidth+1)
+	for i := range huge {
+		huge[i] = &v1.Record{Value: []byte("x")}
+	}
+	_, err = log.AppendBatch(huge)
+	require.ErrorIs(t, err, ErrSegmentFull)
+	off, err = log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+}
+
+func testTruncateAfter(t *testing.T, log *Log) {
+	for i := 0; i < 10; i++ {
+		_, err := log.Append(&v1.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	segments := len(log.segments)
+	require.Greater(t, segments, 2)
+
+	require.NoError(t, log.TruncateAfter(4))
+	require.Less(t, len(log.segments), segments)
+	off, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+	require.Equal(t, uint64(5), log.HighWatermark())
+	_, err = log.Read(5)
+	require.Error(t, err)
+
+	off, err = log.Append(&v1.Record{Value: []byte("new record 5")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+
+	// The truncation survives a restart
+	require.NoError(t, log.Close())
+	log, err = NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	defer log.Close()
+	off, err = log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+	read, err := log.Read(5)
+	require.NoError(t, err)
+	require.Equal(t, []byte("new record 5"), read.Value)
+	read, err = log.Read(4)
+	require.NoError(t, err)
+	require.Equal(t, []byte("record 4"), read.Value)
+
+	// Truncating is idempotent
+	require.NoError(t, log.TruncateAfter(0))
+	require.NoError(t, log.TruncateAfter(0))
+	off, err = log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	_, err = log.Read(1)
 	require.Error(t, err)
 }
+
+func testReadInto(t *testing.T, log *Log) {
+	for i := 0; i < 10; i++ {
+		_, err := log.Append(&v1.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.Greater(t, len(log.segments), 2)
+
+	record := &v1.Record{}
+	for _, off := range []uint64{7, 0, 9, 3} {
+		require.NoError(t, log.ReadInto(off, record))
+		require.Equal(t, off, record.Offset)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", off)), record.Value)
+	}
+	require.Error(t, log.ReadInto(10, record))
+}
+
+func BenchmarkRead(b *testing.B) {
+	for _, segments := range []int{1, 100, 1000, 5000} {
+		b.Run(fmt.Sprintf("segments=%d", segments), func(b *testing.B) {
+			dir, err := os.MkdirTemp("", "read-bench")
+			require.NoError(b, err)
+			defer os.RemoveAll(dir)
+
+			// Every segment holds 4 records
+			config := Config{}
+			config.Segment.MaxIndexBytes = 4 * entryWidth
+			config.Segment.MaxStoreBytes = 1 << 20
+			log, err := NewLog(dir, config)
+			require.NoError(b, err)
+			defer log.Close()
+			records := uint64(4 * segments)
+			value := make([]byte, 256)
+			for i := uint64(0); i < records; i++ {
+				_, err := log.Append(&v1.Record{Value: value})
+				require.NoError(b, err)
+			}
+
+			record := &v1.Record{}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := log.ReadInto(uint64(i)%records, record); err != nil {
+					b.Fatal(err)
+				}
+			}
+			// Closing thousands of segments isn't part of a read
+			b.StopTimer()
+		})
+	}
+}
+
+// BenchmarkReadWhileAppending reads the sealed segments of a log while it's
+// appended to
+func BenchmarkReadWhileAppending(b *testing.B) {
+	dir, err := os.MkdirTemp("", "read-bench")
+	require.NoError(b, err)
+	defer os.RemoveAll(dir)
+
+	config := Config{}
+	config.Segment.MaxIndexBytes = 64 * entryWidth
+	config.Segment.MaxStoreBytes = 1 << 20
+	log, err := NewLog(dir, config)
+	require.NoError(b, err)
+	defer log.Close()
+	const records = 64 * 100
+	value := make([]byte, 256)
+	for i := 0; i < records; i++ {
+		_, err := log.Append(&v1.Record{Value: value})
+		require.NoError(b, err)
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if _, err := log.Append(&v1.Record{Value: value}); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	}()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		record := &v1.Record{}
+		for i := uint64(0); pb.Next(); i++ {
+			if err := log.ReadInto(i%records, record); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+	b.StopTimer()
+	close(stop)
+	<-done
+}
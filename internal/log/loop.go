@@ -0,0 +1,46 @@
+package log
+
+import (
+	"sync"
+	"time"
+)
+
+// loop runs a function in the background every interval until it's closed
+type loop struct {
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func startLoop(interval time.Duration, fn func()) *loop {
+	l := &loop{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(l.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-l.stop:
+				return
+			case <-ticker.C:
+				fn()
+			}
+		}
+	}()
+	return l
+}
+
+// close stops the loop and waits for a run in progress to finish, it's a no-op
+// on a nil loop
+func (l *loop) close() {
+	if l == nil {
+		return
+	}
+	l.stopOnce.Do(func() {
+		close(l.stop)
+		<-l.done
+	})
+}
@@ -0,0 +1,125 @@
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// metadataFile describes the log in its directory, it's written when the
+	// log is created and checked every time it's opened
+	metadataFile = "proglog.meta"
+	// metadataVersion is the version of the on-disk format this package
+	// writes, a log written by a newer version isn't opened
+	metadataVersion = 1
+)
+
+// metadata is the content of metadataFile
+type metadata struct {
+	Version   int            `json:"version"`
+	CreatedAt time.Time      `json:"createdAt"`
+	Config    configSnapshot `json:"config"`
+}
+
+// configSnapshot is the part of the config that shapes the files of the log,
+// it's kept with the log so a change between two opens can be noticed
+type configSnapshot struct {
+	MaxStoreBytes        uint64 `json:"maxStoreBytes"`
+	MaxIndexBytes        uint64 `json:"maxIndexBytes"`
+	MaxRecordBytes       uint64 `json:"maxRecordBytes,omitempty"`
+	IndexIntervalRecords uint64 `json:"indexIntervalRecords,omitempty"`
+	IndexIntervalBytes   uint64 `json:"indexIntervalBytes,omitempty"`
+	Compression          string `json:"compression,omitempty"`
+	CompressPerBatch     bool   `json:"compressPerBatch,omitempty"`
+	Encrypted            bool   `json:"encrypted,omitempty"`
+	Compaction           bool   `json:"compaction,omitempty"`
+}
+
+func newConfigSnapshot(c Config) configSnapshot {
+	s := configSnapshot{
+		MaxStoreBytes:        c.Segment.MaxStoreBytes,
+		MaxIndexBytes:        c.Segment.MaxIndexBytes,
+		MaxRecordBytes:       c.Segment.MaxRecordBytes,
+		IndexIntervalRecords: c.Index.IntervalRecords,
+		IndexIntervalBytes:   c.Index.IntervalBytes,
+		CompressPerBatch:     c.Compression.PerBatch,
+		Encrypted:            c.Encryption.Keys != nil,
+		Compaction:           c.Compaction.Enabled,
+	}
+	if c.Compression.Codec != nil {
+		s.Compression = c.Compression.Codec.Name()
+	}
+	return s
+}
+
+// readMetadata returns the metadata of the log in dir, false when it has none
+func readMetadata(dir string) (metadata, bool, error) {
+	var m metadata
+	b, err := os.ReadFile(filepath.Join(dir, metadataFile))
+	if os.IsNotExist(err) {
+		return m, false, nil
+	}
+	if err != nil {
+		return m, false, err
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return m, false, fmt.Errorf("parsing %s: %w", metadataFile, err)
+	}
+	return m, true, nil
+}
+
+// writeMetadata replaces the metadata of the log in dir atomically
+func writeMetadata(dir string, m metadata) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, metadataFile)
+	tmp := path + ".tmp"
+	if err := writeFileSync(tmp, append(b, '\n')); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// checkMetadata validates the metadata of the log against the config it's
+// opened with and records the new config. A log without one, new or written
+// before the file existed, gets it unless it's opened read-only.
+func (l *Log) checkMetadata() error {
+	m, ok, err := readMetadata(l.Dir)
+	if err != nil {
+		return err
+	}
+	current := newConfigSnapshot(l.Config)
+	if !ok {
+		if l.Config.ReadOnly.Enabled {
+			return nil
+		}
+		m = metadata{Version: metadataVersion, CreatedAt: time.Now().UTC()}
+	} else {
+		if m.Version > metadataVersion {
+			return fmt.Errorf("%s: format version %d is newer than %d", metadataFile, m.Version, metadataVersion)
+		}
+		// Plaintext appends would mix with records nobody could read back
+		if m.Config.Encrypted && !current.Encrypted {
+			return fmt.Errorf("%s: the log is encrypted, Config.Encryption.Keys is needed to open it", metadataFile)
+		}
+		if m.Config == current || l.Config.ReadOnly.Enabled {
+			return nil
+		}
+		slog.Info("log config changed",
+			"dir", l.Dir,
+			"previous", m.Config,
+			"current", current,
+		)
+	}
+	m.Config = current
+	return writeMetadata(l.Dir, m)
+}
@@ -0,0 +1,236 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// defaultRefreshInterval is how often a read-only log picks up what the
+// writer appended
+const defaultRefreshInterval = time.Second
+
+// checkWritable returns ErrReadOnly for a log opened read-only
+func (l *Log) checkWritable() error {
+	if l.Config.ReadOnly.Enabled {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// Refresh picks up the records and segments another process appended to a
+// log opened read-only, and drops the segments it removed. Sealed segments
+// are kept as they are unless their store was replaced by a compaction, the
+// last one is opened again. It's a no-op for a log that isn't read-only,
+// whose view is always current.
+func (l *Log) Refresh() error {
+	if !l.Config.ReadOnly.Enabled {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return ErrLogClosed
+	}
+	return l.refresh()
+}
+
+// refresh opens the segments of a read-only log again, see Refresh. The
+// caller must hold the lock, on errors the log is left as it was. Unlike the
+// writer's, the sealed stores of a read-only log aren't mapped: the writer may
+// cut them short with TruncateAfter, and reading a mapping past the end of its
+// file crashes the process, where a read of the file only comes up short.
+func (l *Log) refresh() error {
+	start, err := readStartOffset(l.Dir)
+	if err != nil {
+		return err
+	}
+	baseOffsets, err := l.scanSegments()
+	if err != nil {
+		return err
+	}
+	previous := make(map[uint64]*Segment, len(l.segments))
+	for _, s := range l.segments {
+		previous[s.baseOffset] = s
+	}
+	var last *Segment
+	if len(l.segments) > 0 {
+		last = l.segments[len(l.segments)-1]
+	}
+
+	var segments, opened []*Segment
+	for i, off := range baseOffsets {
+		if s, ok := previous[off]; ok && s != last && !s.replaced() {
+			segments = append(segments, s)
+			continue
+		}
+		s, err := NewSegment(l.Dir, off, l.Config)
+		if errors.Is(err, errIndexNotReady) {
+			// The writer is creating the segment, or rebuilding its index
+			// after a compaction, the old view of it is good until then
+			if s, ok := previous[off]; ok {
+				segments = append(segments, s)
+				continue
+			}
+			if i == len(baseOffsets)-1 {
+				break
+			}
+		}
+		if err != nil {
+			for _, s := range opened {
+				s.Close()
+			}
+			return fmt.Errorf("opening segment %d: %w", off, err)
+		}
+		segments = append(segments, s)
+		opened = append(opened, s)
+	}
+	if len(segments) == 0 {
+		return fmt.Errorf("opening %s read-only: %w", l.Dir, errNoSegments)
+	}
+
+	kept := make(map[*Segment]bool, len(segments))
+	for _, s := range segments {
+		kept[s] = true
+	}
+	for _, s := range l.segments {
+		if !kept[s] {
+			if err := s.Close(); err != nil {
+				slog.Warn("closing segment failed", "dir", l.Dir, "segment", s.baseOffset, "error", err)
+			}
+		}
+	}
+	l.segments = segments
+	l.activeSegment = segments[len(segments)-1]
+	l.startOffset = start
+	if l.syncer != nil {
+		// The writer may have truncated the end of the log too
+		if next := l.activeSegment.nextOffset; next < l.syncer.durable.next {
+			l.syncer.durable.reset(next)
+		} else {
+			l.syncer.durable.advance(next)
+		}
+	}
+	return nil
+}
+
+// errNoSegments is returned when opening read-only a directory without a
+// segment, there is nothing to read and nothing can be created
+var errNoSegments = errors.New("log has no segments")
+
+// startRefresh refreshes a read-only log in the background
+func startRefresh(l *Log) *loop {
+	if !l.Config.ReadOnly.Enabled {
+		return nil
+	}
+	return startLoop(l.Config.ReadOnly.RefreshInterval, func() {
+		if err := l.Refresh(); err != nil && !errors.Is(err, ErrLogClosed) {
+			slog.Error("refreshing read-only log failed", "dir", l.Dir, "error", err)
+		}
+	})
+}
+
+// openSegmentReadOnly opens the files of a segment read-only, none of them
+// is created or changed. It returns errIndexNotReady when the index doesn't
+// exist yet.
+func openSegmentReadOnly(dir string, baseOffset uint64, c Config) (_ *Segment, err error) {
+	s := &Segment{
+		baseOffset: baseOffset,
+		config:     c,
+	}
+	path := func(ext string) string {
+		return filepath.Join(dir, fmt.Sprintf("%d%s", baseOffset, ext))
+	}
+	var files []*os.File
+	defer func() {
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			if s.index != nil {
+				s.index.mmap.Unmap()
+			}
+			if s.timeIndex != nil {
+				s.timeIndex.Close()
+			}
+		}
+	}()
+	storeFile, err := os.Open(path(storeExt))
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, storeFile)
+	if s.store, err = newStore(storeFile); err != nil {
+		return nil, err
+	}
+	indexFile, err := os.Open(path(indexExt))
+	if os.IsNotExist(err) {
+		return nil, errIndexNotReady
+	}
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, indexFile)
+	if s.index, err = openIndexReadOnly(indexFile); err != nil {
+		return nil, err
+	}
+	if s.timeIndex, err = openTimeIndexReadOnly(path(timeIndexExt)); err != nil {
+		return nil, err
+	}
+	if err := s.hideTail(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// hideTail leaves out the end of a segment opened read-only that wasn't
+// completely written: entries past the records in the store, a partial
+// record and the start of a batch that isn't finished. The writer may still
+// be at it or may have crashed, either way the files aren't touched and only
+// the view of them shrinks.
+func (s *Segment) hideTail() error {
+	_, entries := s.index.validEntries(s.store.size)
+	var end uint64
+	for ; entries > 0; entries-- {
+		pos, f, err := s.readEntry(entries - 1)
+		if err != nil {
+			return err
+		}
+		if f != nil && f.flags&frameFlagContinued == 0 {
+			end = pos + f.width
+			break
+		}
+	}
+	s.index.size = entries * entryWidth
+	// A sparse index leaves records after its last entry, they count once
+	// their batch is complete
+	if s.index.sparse {
+		for pos := end; pos < s.store.size; {
+			_, _, f, err := s.readRecordsAt(pos)
+			if err != nil {
+				break
+			}
+			pos += f.width
+			if f.flags&frameFlagContinued == 0 {
+				end = pos
+			}
+		}
+	}
+	s.store.size = end
+	s.setNextOffset()
+	return nil
+}
+
+// replaced reports whether the store of a segment opened read-only was
+// replaced or removed since it was opened, or cut short by TruncateAfter
+func (s *Segment) replaced() bool {
+	fi, err := os.Stat(s.store.Name())
+	if err != nil {
+		return true
+	}
+	opened, err := s.store.file.Stat()
+	return err != nil || !os.SameFile(fi, opened) || uint64(fi.Size()) < s.store.size
+}
@@ -0,0 +1,356 @@
+package log
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	v1 "github.com/adityavit/proglog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// recovery describes what recover had to change to make a segment consistent
+type recovery struct {
+	// rebuilt is set when the index didn't match the store at all and was
+	// regenerated from it
+	rebuilt bool
+	// droppedEntries is the number of index entries that pointed at records
+	// which never made it into the store
+	droppedEntries uint64
+	// indexedRecords is the number of complete records found in the store
+	// after the last indexed one that got an index entry, a sparse index
+	// leaves most records without one on purpose
+	indexedRecords uint64
+	// truncatedBytes is the size of the partial record cut off the store
+	truncatedBytes uint64
+	// corruptBytes is the size of the damaged frames left in the store,
+	// reading their records returns ErrCorruptRecord
+	corruptBytes uint64
+}
+
+func (r recovery) repaired() bool {
+	return r.rebuilt || r.droppedEntries > 0 || r.indexedRecords > 0 || r.truncatedBytes > 0
+}
+
+// recover brings the index and the store of a segment back in line after the
+// process died while appending. It finds the last index entry that points at
+// an intact record, indexes any complete records written after it and, when
+// cut is set, cuts off a partial record or an unfinished batch at the end of
+// the store. Only the active segment can have such a tail, the store of a
+// sealed one is never shrunk. An index whose first entry doesn't match the
+// store is rebuilt from scratch.
+func (s *Segment) recover(cut bool) (recovery, error) {
+	written, entries := s.index.validEntries(s.store.size)
+	if entries > 0 {
+		_, f, err := s.readEntry(0)
+		if err != nil {
+			return recovery{}, err
+		}
+		if f == nil {
+			return s.rebuildIndex(cut)
+		}
+	}
+
+	// Cross check the last entry against the record it points at, entries of
+	// a batch that may not have been written completely are dropped too so
+	// the batch gets checked as a whole
+	var end uint64
+	for ; entries > 0; entries-- {
+		pos, f, err := s.readEntry(entries - 1)
+		if err != nil {
+			return recovery{}, err
+		}
+		if f == nil || f.flags&frameFlagContinued != 0 {
+			continue
+		}
+		end = pos + f.width
+		// Only some entries of a batch frame may have made it into the
+		// index, the frame is indexed again as a whole
+		if f.flags&frameFlagBatch != 0 {
+			end = pos
+			for ; entries > 0; entries-- {
+				if _, p, _ := s.index.Read(int64(entries - 1)); p != pos {
+					break
+				}
+			}
+		}
+		break
+	}
+	dropped := bytes.Clone(s.index.entries[entries*entryWidth : written*entryWidth])
+	s.index.truncate(entries)
+
+	r, err := s.indexFrom(end, cut)
+	if err != nil {
+		return r, err
+	}
+	// Entries that were only dropped to check their records again and were
+	// written back as they were aren't a repair
+	rewritten := s.index.entries[entries*entryWidth : s.index.size]
+	var same uint64
+	for at := 0; at+entryWidth <= min(len(dropped), len(rewritten)); at += entryWidth {
+		if !bytes.Equal(dropped[at:at+entryWidth], rewritten[at:at+entryWidth]) {
+			break
+		}
+		same++
+	}
+	r.droppedEntries = written - entries - same
+	r.indexedRecords -= same
+	return r, nil
+}
+
+// rebuildIndex throws away the index and regenerates it by walking the
+// records in the store, cutting off a partial record at the end of it when
+// cut is set. Damaged records are skipped, see indexFrom, so the store of a
+// sealed segment is never shrunk. An index that comes out as it was isn't
+// reported as rebuilt.
+func (s *Segment) rebuildIndex(cut bool) (recovery, error) {
+	old := bytes.Clone(s.index.entries[:min(s.index.size, uint64(len(s.index.entries)))])
+	s.index.truncate(0)
+	s.index.writeHeader()
+	r, err := s.indexFrom(0, cut)
+	if err != nil {
+		return r, err
+	}
+	if !bytes.Equal(old, s.index.entries[:s.index.size]) {
+		r.rebuilt = true
+	} else {
+		r.indexedRecords = 0
+	}
+	return r, nil
+}
+
+// readEntry returns the position and the frame of the record the nth index
+// entry points at. The frame is nil when the entry doesn't point at an intact
+// record with the offset it was indexed under.
+func (s *Segment) readEntry(n uint64) (uint64, *frame, error) {
+	off, pos, err := s.index.Read(int64(n))
+	if err != nil {
+		return 0, nil, err
+	}
+	records, _, f, err := s.readRecordsAt(pos)
+	if isCorrupt(err) {
+		return pos, nil, nil
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	for _, record := range records {
+		if record.Offset == s.baseOffset+uint64(off) {
+			return pos, f, nil
+		}
+	}
+	return pos, nil, nil
+}
+
+// indexFrom indexes the complete records in the store starting at pos. Records
+// of a batch are only indexed once the whole batch was found. A damaged frame
+// followed by intact ones is skipped and indexed under the offsets it should
+// hold, so reading them returns ErrCorruptRecord. Whatever is left after the
+// last intact frame is a record that was only partially written or a batch
+// that was never finished, it's cut off when cut is set and indexed as it is
+// otherwise.
+func (s *Segment) indexFrom(pos uint64, cut bool) (recovery, error) {
+	var r recovery
+	// The time index can't be ahead of the index
+	s.nextOffset = s.offsetBefore(pos)
+	s.timeIndex.truncateFrom(s.nextOffset - s.baseOffset)
+	type entry struct {
+		off       uint64
+		pos       uint64
+		timestamp int64
+	}
+	var batch []entry
+	// index writes the entries of the records in the batch, force writes one
+	// for its first record even when a sparse index isn't due for it
+	index := func(force bool) error {
+		for i, e := range batch {
+			// A sparse index only ever points at the first record of a frame
+			if !s.index.sparse || i == 0 || e.pos != batch[i-1].pos {
+				size := s.index.size
+				var err error
+				if force && i == 0 {
+					err = s.index.Write(e.off, e.pos)
+				} else {
+					err = s.indexRecord(s.baseOffset+e.off, e.pos)
+				}
+				if err != nil {
+					return err
+				}
+				if s.index.size > size {
+					r.indexedRecords++
+				}
+			}
+			if err := s.timeIndex.Write(e.timestamp, e.off); err != nil {
+				return err
+			}
+		}
+		batch = batch[:0]
+		return nil
+	}
+	next, end, skipped := s.nextOffset, pos, false
+	for pos < s.store.size {
+		records, _, f, err := s.readRecordsAt(pos)
+		if isCorrupt(err) {
+			at, first, found, err := s.nextFrame(pos, next)
+			if err != nil {
+				return r, err
+			}
+			if !found {
+				break
+			}
+			// The records of a batch before the damaged frame are intact
+			if err := index(skipped); err != nil {
+				return r, err
+			}
+			for off := next; off < first; off++ {
+				if err := s.index.Write(off-s.baseOffset, pos); err != nil {
+					return r, err
+				}
+				// A sparse index needs a single entry
+				if s.index.sparse {
+					break
+				}
+			}
+			r.corruptBytes += at - pos
+			next, pos, end, skipped = first, at, at, true
+			continue
+		}
+		if err != nil {
+			return r, err
+		}
+		for _, record := range records {
+			batch = append(batch, entry{
+				off:       record.Offset - s.baseOffset,
+				pos:       pos,
+				timestamp: record.Timestamp,
+			})
+		}
+		next = records[len(records)-1].Offset + 1
+		pos += f.width
+		if f.flags&frameFlagContinued != 0 {
+			continue
+		}
+		// Reads of the records after a damaged frame must not have to go
+		// through it
+		if err := index(skipped); err != nil {
+			return r, err
+		}
+		end, skipped = pos, false
+	}
+
+	switch {
+	case end == s.store.size:
+	case cut:
+		r.truncatedBytes = s.store.size - end
+		if err := s.store.Truncate(end); err != nil {
+			return r, err
+		}
+	default:
+		// A sealed store keeps its tail, the records of an unfinished batch
+		// are intact and a damaged frame is indexed under the offset after
+		// them so reading it returns ErrCorruptRecord
+		if err := index(skipped); err != nil {
+			return r, err
+		}
+		if pos < s.store.size {
+			if err := s.index.Write(next-s.baseOffset, pos); err != nil {
+				return r, err
+			}
+			r.corruptBytes += s.store.size - pos
+		}
+	}
+	s.setNextOffset()
+	return r, nil
+}
+
+// nextFrame finds the first intact frame after the damaged one at pos, with
+// records from the offset next on, and returns its position and first offset.
+// Only version 1 frames are looked for, their checksum tells them apart from
+// the damaged bytes.
+func (s *Segment) nextFrame(pos, next uint64) (at, first uint64, found bool, err error) {
+	buf := make([]byte, 64<<10)
+	for start := pos + 1; start < s.store.size; start += uint64(len(buf)) {
+		n, err := s.store.ReadAt(buf, int64(start))
+		if err != nil && !errors.Is(err, io.EOF) {
+			return 0, 0, false, err
+		}
+		for i := 0; i < n; i++ {
+			if buf[i] != frameVersion1 {
+				continue
+			}
+			records, _, _, err := s.readRecordsAt(start + uint64(i))
+			if isCorrupt(err) {
+				continue
+			}
+			if err != nil {
+				return 0, 0, false, err
+			}
+			if records[0].Offset >= next {
+				return start + uint64(i), records[0].Offset, true, nil
+			}
+		}
+	}
+	return 0, 0, false, nil
+}
+
+// rebuildTimeIndex regenerates the time index from the records in the store
+func (s *Segment) rebuildTimeIndex() error {
+	s.timeIndex.truncateFrom(0)
+	for pos := uint64(0); pos < s.store.size; {
+		records, _, f, err := s.readRecordsAt(pos)
+		if isCorrupt(err) {
+			// A torn tail is left to recover
+			break
+		}
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			if err := s.timeIndex.Write(record.Timestamp, record.Offset-s.baseOffset); err != nil {
+				return err
+			}
+		}
+		pos += f.width
+	}
+	return nil
+}
+
+// readRecordsAt decodes the records in the frame at pos and returns them
+// along with their marshaled form and the frame
+func (s *Segment) readRecordsAt(pos uint64) ([]*v1.Record, [][]byte, *frame, error) {
+	f, err := s.store.ReadFrame(pos)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	payloads, err := s.decodeFrame(pos, f)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	records := make([]*v1.Record, len(payloads))
+	for i, p := range payloads {
+		records[i] = &v1.Record{}
+		// Legacy frames carry no checksum, so a damaged one only shows up here
+		if err := proto.Unmarshal(p, records[i]); err != nil {
+			return nil, nil, nil, s.store.corrupt(pos, err.Error())
+		}
+	}
+	return records, payloads, f, nil
+}
+
+// decodeFrame returns the marshaled records in the frame at pos
+func (s *Segment) decodeFrame(pos uint64, f *frame) ([][]byte, error) {
+	payloads, err := f.records(s.config.Encryption.Keys)
+	if isKeyError(err) {
+		return nil, fmt.Errorf("decrypting record at position %d of %s: %w", pos, s.store.Name(), err)
+	}
+	if err != nil {
+		return nil, s.store.corrupt(pos, err.Error())
+	}
+	return payloads, nil
+}
+
+func isCorrupt(err error) bool {
+	var corrupt *ErrCorruptRecord
+	return errors.As(err, &corrupt) || errors.Is(err, io.EOF)
+}
@@ -0,0 +1,81 @@
+package log
+
+import (
+	"log/slog"
+	"os"
+	"time"
+)
+
+const defaultRetentionCheckInterval = 5 * time.Minute
+
+// startRetention starts applying the Retention config of the log in the
+// background, it returns nil when nothing has to be removed
+func startRetention(l *Log) *loop {
+	c := l.Config.Retention
+	if c.MaxBytes == 0 && c.MaxAge == 0 {
+		return nil
+	}
+	return startLoop(c.CheckInterval, func() {
+		if _, err := l.applyRetention(time.Now()); err != nil {
+			slog.Error("applying retention failed", "dir", l.Dir, "error", err)
+		}
+	})
+}
+
+// applyRetention removes the oldest segments while the log is larger than
+// Retention.MaxBytes or their newest record is older than Retention.MaxAge.
+// Only whole segments are removed, never the active one or any of the last
+// Retention.MinSegments. It returns how many segments were removed.
+func (l *Log) applyRetention(now time.Time) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c := l.Config.Retention
+	var size uint64
+	for _, s := range l.segments {
+		size += s.store.size
+	}
+	removed := 0
+	for len(l.segments) > max(c.MinSegments, 1) {
+		oldest := l.segments[0]
+		tooBig := c.MaxBytes > 0 && size > c.MaxBytes
+		tooOld := false
+		if c.MaxAge > 0 {
+			lastAppend, err := oldest.lastAppend()
+			if err != nil {
+				return removed, err
+			}
+			tooOld = now.Sub(lastAppend) > c.MaxAge
+		}
+		if !tooBig && !tooOld {
+			break
+		}
+		if err := oldest.Remove(); err != nil {
+			return removed, err
+		}
+		slog.Info("removed segment past retention",
+			"dir", l.Dir,
+			"segment", oldest.baseOffset,
+			"nextOffset", oldest.nextOffset,
+			"bytes", oldest.store.size,
+			"tooBig", tooBig,
+			"tooOld", tooOld,
+		)
+		size -= oldest.store.size
+		l.segments = l.segments[1:]
+		removed++
+	}
+	return removed, nil
+}
+
+// lastAppend returns the newest timestamp in the segment, falling back to the
+// time the store was last written to for a segment without one
+func (s *Segment) lastAppend() (time.Time, error) {
+	if ts, ok := s.timeIndex.MaxTimestamp(); ok {
+		return time.UnixMilli(ts), nil
+	}
+	fi, err := os.Stat(s.store.Name())
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
@@ -0,0 +1,95 @@
+package log
+
+import (
+	"testing"
+	"time"
+
+	v1 "github.com/adityavit/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// newRetentionLog opens a test log with a segment for every timestamp
+func newRetentionLog(t *testing.T, config Config, timestamps ...time.Time) *Log {
+	// Every record fills up a segment of its own
+	config.Segment.MaxIndexBytes = entryWidth
+	config.Timestamps.UseProducerTime = true
+	log := newTestLog(t, config)
+	for _, ts := range timestamps {
+		_, err := log.Append(&v1.Record{Value: []byte("hello world"), Timestamp: ts.UnixMilli()})
+		require.NoError(t, err)
+	}
+	return log
+}
+
+func TestRetentionMaxBytes(t *testing.T) {
+	now := time.Now()
+	config := Config{}
+	config.Retention.MaxBytes = 100
+	log := newRetentionLog(t, config, now, now, now, now, now, now)
+	defer log.Close()
+	require.Len(t, log.segments, 7)
+
+	removed, err := log.applyRetention(now)
+	require.NoError(t, err)
+	require.Greater(t, removed, 0)
+	var size uint64
+	for _, s := range log.segments {
+		size += s.store.size
+	}
+	require.LessOrEqual(t, size, uint64(100))
+
+	// Removed records can't be read anymore, the rest can
+	_, err = log.Read(0)
+	require.Error(t, err)
+	read, err := log.Read(5)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), read.Offset)
+}
+
+func TestRetentionMaxAge(t *testing.T) {
+	now := time.Now()
+	config := Config{}
+	config.Retention.MaxAge = time.Hour
+	log := newRetentionLog(t, config,
+		now.Add(-3*time.Hour), now.Add(-2*time.Hour), now.Add(-time.Minute), now.Add(-3*time.Hour))
+	defer log.Close()
+	require.Len(t, log.segments, 5)
+
+	// Removal stops at the first segment that is still fresh
+	removed, err := log.applyRetention(now)
+	require.NoError(t, err)
+	require.Equal(t, 2, removed)
+	require.Equal(t, uint64(2), log.segments[0].baseOffset)
+}
+
+func TestRetentionMinSegments(t *testing.T) {
+	now := time.Now()
+	config := Config{}
+	config.Retention.MaxAge = time.Hour
+	config.Retention.MinSegments = 3
+	log := newRetentionLog(t, config,
+		now.Add(-3*time.Hour), now.Add(-3*time.Hour), now.Add(-3*time.Hour), now.Add(-3*time.Hour))
+	defer log.Close()
+
+	removed, err := log.applyRetention(now)
+	require.NoError(t, err)
+	require.Equal(t, 2, removed)
+	require.Len(t, log.segments, 3)
+}
+
+func TestRetentionLoop(t *testing.T) {
+	now := time.Now()
+	config := Config{}
+	config.Retention.MaxAge = time.Hour
+	config.Retention.CheckInterval = time.Millisecond
+	log := newRetentionLog(t, config, now.Add(-2*time.Hour), now.Add(-2*time.Hour))
+	defer log.Close()
+
+	// Only the active segment is left once the loop ran
+	require.Eventually(t, func() bool {
+		log.mu.RLock()
+		defer log.mu.RUnlock()
+		return len(log.segments) == 1
+	}, time.Second, time.Millisecond)
+	require.Equal(t, log.activeSegment, log.segments[0])
+}
@@ -1,9 +1,13 @@
 package log
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"sort"
+	"time"
 
 	v1 "github.com/adityavit/proglog/api/v1"
 	"google.golang.org/protobuf/proto"
@@ -12,17 +16,32 @@ import (
 type Segment struct {
 	store      *store
 	index      *index
+	timeIndex  *timeIndex
 	config     Config
 	baseOffset uint64
 	nextOffset uint64
 }
 
+// The files of a segment are named after its base offset with these
+// extensions
+const (
+	storeExt     = ".store"
+	indexExt     = ".index"
+	timeIndexExt = ".timeindex"
+	// orphanedExt is added to the index files of a segment whose store is
+	// gone, they are kept for inspection but never opened
+	orphanedExt = ".orphaned"
+)
+
 func NewSegment(dir string, baseOffset uint64, c Config) (*Segment, error) {
+	if c.ReadOnly.Enabled {
+		return openSegmentReadOnly(dir, baseOffset, c)
+	}
 	segment := &Segment{
 		baseOffset: baseOffset,
 		config:     c,
 	}
-	storeFile, err := os.OpenFile(filepath.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store")), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	storeFile, err := os.OpenFile(filepath.Join(dir, fmt.Sprintf("%d%s", baseOffset, storeExt)), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
 	if err != nil {
 		return nil, err
 	}
@@ -30,7 +49,10 @@ func NewSegment(dir string, baseOffset uint64, c Config) (*Segment, error) {
 	if err != nil {
 		return nil, err
 	}
-	indexFile, err := os.OpenFile(filepath.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index")), os.O_RDWR|os.O_CREATE, 0644)
+	indexPath := filepath.Join(dir, fmt.Sprintf("%d%s", baseOffset, indexExt))
+	_, err = os.Stat(indexPath)
+	indexMissing := errors.Is(err, fs.ErrNotExist)
+	indexFile, err := os.OpenFile(indexPath, os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
 		return nil, err
 	}
@@ -38,56 +60,482 @@ func NewSegment(dir string, baseOffset uint64, c Config) (*Segment, error) {
 	if err != nil {
 		return nil, err
 	}
+	timeIndexFile, err := os.OpenFile(filepath.Join(dir, fmt.Sprintf("%d%s", baseOffset, timeIndexExt)), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	segment.timeIndex, err = newTimeIndex(timeIndexFile, c)
+	if err != nil {
+		return nil, err
+	}
+	// Without an index the records in the store can still be found by
+	// walking it, which is also how an index is switched between dense and
+	// sparse. The store is left as it is, a torn tail is cut off by the
+	// recovery of the active segment.
+	sparse := c.sparseIndex()
+	if indexMissing && segment.store.size > 0 || segment.index.sparse != sparse {
+		segment.index.sparse = sparse
+		if _, err := segment.rebuildIndex(false); err != nil {
+			return nil, err
+		}
+		return segment, nil
+	}
+	segment.setNextOffset()
+	// Segments written before records carried timestamps have no time index
+	if _, ok := segment.timeIndex.MaxTimestamp(); !ok && segment.nextOffset > baseOffset {
+		if err := segment.rebuildTimeIndex(); err != nil {
+			return nil, err
+		}
+	}
+	return segment, nil
+}
+
+func (s *Segment) setNextOffset() {
+	s.nextOffset = s.offsetBefore(s.store.size)
+}
+
+// offsetBefore returns the offset after the records in the frames before pos,
+// only the frames after the last index entry of a sparse index are read
+func (s *Segment) offsetBefore(pos uint64) uint64 {
 	// If can read the last entry, then we know the next offset
 	// Otherwise, we start at the base offset
-	if off, _, err := segment.index.Read(-1); err != nil {
-		segment.nextOffset = baseOffset
-	} else {
-		segment.nextOffset = baseOffset + uint64(off) + 1
+	off, at, err := s.index.Read(-1)
+	if err != nil {
+		return s.baseOffset
 	}
-
-	return segment, nil
+	if !s.index.sparse {
+		return s.baseOffset + off + 1
+	}
+	// The records of a batch only count once the whole batch is there
+	next := s.baseOffset + off
+	for at < pos {
+		records, _, f, err := s.readRecordsAt(at)
+		if err != nil {
+			// A torn tail is left to recover
+			break
+		}
+		at += f.width
+		if f.flags&frameFlagContinued == 0 {
+			next = records[len(records)-1].Offset + 1
+		}
+	}
+	return next
 }
 
+// Append appends the record and returns its offset. It returns ErrSegmentFull
+// when the record doesn't fit in what's left of the segment, and
+// ErrRecordTooLarge when it doesn't even fit in an empty one.
 func (s *Segment) Append(record *v1.Record) (offset uint64, err error) {
-	// log.Printf("Appending record to segment %v", s)
 	cur := s.nextOffset
-	record.Offset = cur
-	p, err := proto.Marshal(record)
+	n, err := s.appendUpTo([]*v1.Record{record})
 	if err != nil {
 		return 0, err
 	}
-	_, pos, err := s.store.Append(p)
-	// fmt.Printf("n: %d, pos: %d, curOffset: %d\n", n, pos, cur)
+	if n == 0 {
+		if s.nextOffset == s.baseOffset && s.entriesLeft() > 0 {
+			return 0, ErrRecordTooLarge
+		}
+		return 0, ErrSegmentFull
+	}
+	return cur, nil
+}
+
+// AppendBatch appends all of the records with contiguous offsets or none of
+// them and returns the offset of the first one. A batch only goes into a
+// segment it fits in.
+func (s *Segment) AppendBatch(records []*v1.Record) (uint64, error) {
+	first := s.nextOffset
+	if !s.index.sparse && len(records) > s.entriesLeft() {
+		return 0, ErrSegmentFull
+	}
+	payloads, err := s.marshal(records)
 	if err != nil {
 		return 0, err
 	}
-	// Write the index entry
-	// We subtract the base offset because stored offset in the index is relative to the base offset
-	if err = s.index.Write(uint32(s.nextOffset-uint64(s.baseOffset)), pos); err != nil {
+	frames, flags, err := encodePayloads(s.config, payloads)
+	if err != nil {
 		return 0, err
 	}
-	s.nextOffset++
-	return cur, nil
+	if s.framesFit(frames, flags, len(records)) < len(frames) {
+		return 0, ErrSegmentFull
+	}
+	if err := s.writeFrames(records, frames, flags, true); err != nil {
+		return 0, err
+	}
+	return first, nil
 }
 
-func (s *Segment) Read(off uint64) (*v1.Record, error) {
-	// Read the index entry
-	_, pos, err := s.index.Read(int64(off - s.baseOffset))
+// appendUpTo appends the records that fit in the segment and returns how many
+// of them were appended, they get contiguous offsets and are written to the
+// store at once. Records are checked against MaxStoreBytes once compressed and
+// encrypted, before they are written, so the store never outgrows it.
+func (s *Segment) appendUpTo(records []*v1.Record) (int, error) {
+	n := len(records)
+	if !s.index.sparse {
+		n = min(n, s.entriesLeft())
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	payloads, err := s.marshal(records[:n])
+	if err != nil {
+		return 0, err
+	}
+	for n > 0 {
+		frames, flags, err := encodePayloads(s.config, payloads[:n])
+		if err != nil {
+			return 0, err
+		}
+		switch fit := s.framesFit(frames, flags, n); {
+		case fit == len(frames):
+		case flags&frameFlagBatch == 0:
+			// Every record has a frame of its own, the ones that fit go in
+			n, frames = fit, frames[:fit]
+		default:
+			// The records share a frame, which is encoded again with fewer
+			// of them
+			n /= 2
+			continue
+		}
+		if n == 0 {
+			break
+		}
+		return n, s.writeFrames(records[:n], frames, flags, false)
+	}
+	return 0, nil
+}
+
+// entriesLeft returns how many more records the index has room for
+func (s *Segment) entriesLeft() int {
+	return int((uint64(len(s.index.entries)) - s.index.size) / entryWidth)
+}
+
+// framesFit returns how many of the frames of n records, from the first one
+// on, fit in the store without growing it past MaxStoreBytes and have room
+// for their entries in the index
+func (s *Segment) framesFit(frames [][]byte, flags byte, n int) int {
+	size, entries := s.store.size, s.entriesLeft()
+	next := s.nextOffset
+	last, lastPos, err := s.index.Read(-1)
+	indexed := err == nil
+	for i, f := range frames {
+		records := 1
+		if flags&frameFlagBatch != 0 {
+			records = n
+		}
+		need := records
+		if s.index.sparse {
+			need = 0
+			if rel := next - s.baseOffset; !indexed || s.config.indexDue(rel-last, size-lastPos) {
+				need, last, lastPos, indexed = 1, rel, size, true
+			}
+		}
+		size += frameHeaderWidth + uint64(len(f))
+		if size > s.config.Segment.MaxStoreBytes || need > entries {
+			return i
+		}
+		entries -= need
+		next += uint64(records)
+	}
+	return len(frames)
+}
+
+// fitsEmpty reports whether the records fit in an empty segment, encoded as
+// they would be appended, so a segment is only rolled for records that fit in
+// the next one
+func (s *Segment) fitsEmpty(records []*v1.Record) (bool, error) {
+	if !s.index.sparse && uint64(len(records)) > s.config.Segment.MaxIndexBytes/entryWidth {
+		return false, nil
+	}
+	payloads, err := s.marshal(records)
+	if err != nil {
+		return false, err
+	}
+	frames, _, err := encodePayloads(s.config, payloads)
+	if err != nil {
+		return false, err
+	}
+	var size uint64
+	for _, f := range frames {
+		size += frameHeaderWidth + uint64(len(f))
+	}
+	return size <= s.config.Segment.MaxStoreBytes, nil
+}
+
+// marshal assigns the next offsets and the append time to the records and
+// marshals them
+func (s *Segment) marshal(records []*v1.Record) ([][]byte, error) {
+	payloads := make([][]byte, len(records))
+	now := time.Now().UnixMilli()
+	for i, record := range records {
+		record.Offset = s.nextOffset + uint64(i)
+		if !s.config.Timestamps.UseProducerTime || record.Timestamp == 0 {
+			record.Timestamp = now
+		}
+		p, err := proto.Marshal(record)
+		if err != nil {
+			return nil, err
+		}
+		payloads[i] = p
+	}
+	return payloads, nil
+}
+
+// write appends the marshaled records to the store at once and indexes them,
+// linked records are recovered all together or not at all. The caller must
+// have checked they fit in the index.
+func (s *Segment) write(records []*v1.Record, payloads [][]byte, linked bool) error {
+	frames, flags, err := encodePayloads(s.config, payloads)
+	if err != nil {
+		return err
+	}
+	return s.writeFrames(records, frames, flags, linked)
+}
+
+// writeFrames is write for records already encoded into frames
+func (s *Segment) writeFrames(records []*v1.Record, frames [][]byte, flags byte, linked bool) error {
+	storeSize := s.store.size
+	_, positions, err := s.store.AppendBatch(frames, flags, linked)
 	if err != nil {
+		// Don't leave part of the records behind
+		_ = s.store.Truncate(storeSize)
+		return err
+	}
+	for i := range records {
+		// The records of a batch frame are all indexed at its position, a
+		// sparse index only ever points at the first one
+		pos := positions[min(i, len(positions)-1)]
+		if !s.index.sparse || i < len(positions) {
+			if err := s.indexRecord(s.nextOffset, pos); err != nil {
+				return err
+			}
+		}
+		if err := s.timeIndex.Write(records[i].Timestamp, s.nextOffset-s.baseOffset); err != nil {
+			return err
+		}
+		s.nextOffset++
+	}
+	return nil
+}
+
+// indexRecord writes the index entry of the record at the offset, which is in
+// the frame at pos. A sparse index only gets it for the first record of a
+// frame that comes far enough after the last entry.
+func (s *Segment) indexRecord(offset, pos uint64) error {
+	// The index holds offsets relative to the base offset
+	rel := offset - s.baseOffset
+	if s.index.sparse {
+		if last, lastPos, err := s.index.Read(-1); err == nil && !s.config.indexDue(rel-last, pos-lastPos) {
+			return nil
+		}
+	}
+	return s.index.Write(rel, pos)
+}
+
+// Read returns the record at the offset, or the first one after it when the
+// offset was compacted away. It returns io.EOF when there is no such record
+// in the segment.
+func (s *Segment) Read(off uint64) (*v1.Record, error) {
+	record := &v1.Record{}
+	if err := s.ReadInto(off, record); err != nil {
 		return nil, err
 	}
-	p, err := s.store.Read(pos)
+	return record, nil
+}
+
+// ReadInto is Read into a record the caller provides
+func (s *Segment) ReadInto(off uint64, record *v1.Record) error {
+	pos, err := s.seek(off)
+	if err != nil {
+		return err
+	}
+	for {
+		f, err := s.store.ReadFrame(pos)
+		if err != nil {
+			return err
+		}
+		payloads, err := s.decodeFrame(pos, f)
+		if err != nil {
+			return err
+		}
+		// A batch frame holds the records before and after the one asked for too
+		for _, p := range payloads {
+			if err := proto.Unmarshal(p, record); err != nil {
+				return s.store.corrupt(pos, err.Error())
+			}
+			if record.Offset >= off {
+				return nil
+			}
+		}
+		if !s.index.sparse {
+			return s.store.corrupt(pos, fmt.Sprintf("frame is missing offset %d", off))
+		}
+		pos += f.width
+	}
+}
+
+// readFrom returns the records in the frame holding the record at the offset,
+// or the first one after it, starting from that record
+func (s *Segment) readFrom(off uint64) ([]*v1.Record, error) {
+	pos, err := s.seek(off)
 	if err != nil {
 		return nil, err
 	}
-	record := &v1.Record{}
-	err = proto.Unmarshal(p, record)
-	return record, err
+	for {
+		records, _, f, err := s.readRecordsAt(pos)
+		if err != nil {
+			return nil, err
+		}
+		// A batch frame holds the records before the one asked for too
+		for i, record := range records {
+			if record.Offset >= off {
+				return records[i:], nil
+			}
+		}
+		if !s.index.sparse {
+			return nil, s.store.corrupt(pos, fmt.Sprintf("frame is missing offset %d", off))
+		}
+		pos += f.width
+	}
+}
+
+// seek returns the position of the frame to read the record at the offset, or
+// the first one after it, from. A dense index points right at it, reads of a
+// sparse index scan the frames forward from the entry before it.
+func (s *Segment) seek(off uint64) (uint64, error) {
+	rel := off - s.baseOffset
+	if s.index.sparse {
+		_, pos, err := s.index.Floor(rel)
+		return pos, err
+	}
+	_, pos, err := s.index.Search(rel)
+	return pos, err
+}
+
+// locate returns the position of the frame holding the record at the offset,
+// or the first one after it
+func (s *Segment) locate(off uint64) (uint64, error) {
+	pos, err := s.seek(off)
+	if err != nil || !s.index.sparse {
+		return pos, err
+	}
+	for {
+		records, _, f, err := s.readRecordsAt(pos)
+		if err != nil {
+			return 0, err
+		}
+		if records[len(records)-1].Offset >= off {
+			return pos, nil
+		}
+		pos += f.width
+	}
+}
+
+// OffsetForTime returns the offset of the first record in the segment with a
+// timestamp at or after the given one
+func (s *Segment) OffsetForTime(timestamp int64) (uint64, bool) {
+	off, ok := s.timeIndex.Lookup(timestamp)
+	if !ok {
+		return 0, false
+	}
+	return s.baseOffset + uint64(off), true
+}
+
+// Flush writes the buffered records to the store file
+func (s *Segment) Flush() error {
+	return s.store.Flush()
+}
+
+// Sync syncs the store and the index to disk
+func (s *Segment) Sync() error {
+	if err := s.store.Sync(); err != nil {
+		return err
+	}
+	if err := s.index.Sync(); err != nil {
+		return err
+	}
+	return s.timeIndex.Sync()
+}
+
+// Seal makes the segment read-only once it's no longer the active one, reads
+// of a sealed segment don't lock its store
+func (s *Segment) Seal() error {
+	return s.store.Seal()
+}
+
+// TruncateAfter removes the records after the offset from the segment and
+// syncs it, the segment can be appended to again afterwards. A frame holding
+// records on both sides of the offset, or linked to a frame after it, is
+// written again with just the records up to the offset.
+func (s *Segment) TruncateAfter(offset uint64) error {
+	if offset+1 >= s.nextOffset {
+		return nil
+	}
+	if err := s.store.Unseal(); err != nil {
+		return err
+	}
+	// Walk the frames from the index entry before the offset, the store is
+	// cut after the last one holding a record up to the offset
+	_, cut, err := s.index.Floor(offset - s.baseOffset)
+	if err != nil {
+		return err
+	}
+	var last struct {
+		pos     uint64
+		records []*v1.Record
+		ps      [][]byte
+		f       *frame
+	}
+	for {
+		records, ps, f, err := s.readRecordsAt(cut)
+		if err != nil {
+			return err
+		}
+		if records[0].Offset > offset {
+			break
+		}
+		last.pos, last.records, last.ps, last.f = cut, records, ps, f
+		cut += f.width
+		if records[len(records)-1].Offset > offset {
+			break
+		}
+	}
+	var rewrite []*v1.Record
+	var payloads [][]byte
+	if last.f != nil && (last.records[len(last.records)-1].Offset > offset || last.f.flags&frameFlagContinued != 0) {
+		for i, record := range last.records {
+			if record.Offset <= offset {
+				rewrite = append(rewrite, record)
+				payloads = append(payloads, last.ps[i])
+			}
+		}
+		cut = last.pos
+	}
+	keep := uint64(sort.Search(int(s.index.size/entryWidth), func(j int) bool {
+		_, pos, _ := s.index.Read(int64(j))
+		return pos >= cut
+	}))
+
+	s.index.truncate(keep)
+	if err := s.store.Truncate(cut); err != nil {
+		return err
+	}
+	s.setNextOffset()
+	s.timeIndex.truncateFrom(s.nextOffset - s.baseOffset)
+	if len(rewrite) > 0 {
+		s.nextOffset = rewrite[0].Offset
+		if err := s.write(rewrite, payloads, false); err != nil {
+			return err
+		}
+	}
+	return s.Sync()
 }
 
+// IsMaxed reports whether the store reached MaxStoreBytes or the index has
+// no room for another entry. A segment that isn't maxed may still be too full
+// for the next record, appending it then returns ErrSegmentFull.
 func (s *Segment) IsMaxed() bool {
-	return s.store.size >= s.config.Segment.MaxStoreBytes || s.index.size >= s.config.Segment.MaxIndexBytes
+	return s.store.size >= s.config.Segment.MaxStoreBytes || s.entriesLeft() == 0
 }
 
 func (s *Segment) Remove() error {
@@ -97,6 +545,9 @@ func (s *Segment) Remove() error {
 	if err := os.Remove(s.index.Name()); err != nil {
 		return err
 	}
+	if err := os.Remove(s.timeIndex.Name()); err != nil {
+		return err
+	}
 	if err := os.Remove(s.store.Name()); err != nil {
 		return err
 	}
@@ -107,6 +558,9 @@ func (s *Segment) Close() error {
 	if err := s.index.Close(); err != nil {
 		return err
 	}
+	if err := s.timeIndex.Close(); err != nil {
+		return err
+	}
 	if err := s.store.Close(); err != nil {
 		return err
 	}
@@ -1,9 +1,10 @@
 package log
 
 import (
-	"io"
+	"fmt"
 	"os"
 	"testing"
+	"time"
 
 	v1 "github.com/adityavit/proglog/api/v1"
 	"github.com/stretchr/testify/require"
@@ -18,7 +19,7 @@ func TestNewSegment(t *testing.T) {
 		Value: []byte("hello world"),
 	}
 	wantRecords := uint64(3)
-	config.Segment.MaxStoreBytes = uint64(len(wantRecord.Value) * int(wantRecords))
+	config.Segment.MaxStoreBytes = 1024
 	// Store 3 entries
 	config.Segment.MaxIndexBytes = entryWidth * wantRecords
 	s, err := NewSegment(dir, 16, config)
@@ -40,7 +41,7 @@ func TestNewSegment(t *testing.T) {
 	}
 	// Write a record that exceeds the max index entry size
 	_, err = s.Append(&wantRecord)
-	require.Equal(t, io.EOF, err)
+	require.ErrorIs(t, err, ErrSegmentFull)
 	require.True(t, s.IsMaxed())
 
 	// Test max store bytes, already 3 entries exist, so maxed out
@@ -58,3 +59,393 @@ func TestNewSegment(t *testing.T) {
 	require.NoError(t, err)
 	require.False(t, s.IsMaxed())
 }
+
+func TestSegmentRecover(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "segment-recover-test")
+	defer os.RemoveAll(dir)
+
+	config := Config{}
+	config.Segment.MaxStoreBytes = 1024
+	config.Segment.MaxIndexBytes = 1024
+	s, err := NewSegment(dir, 16, config)
+	require.NoError(t, err)
+
+	wantRecord := &v1.Record{Value: []byte("hello world")}
+	for i := 0; i < 3; i++ {
+		_, err := s.Append(wantRecord)
+		require.NoError(t, err)
+	}
+	// Simulate a crash: the records reach the files but the segment is never
+	// closed, then a partial record is left at the end of the store
+	require.NoError(t, s.store.buf.Flush())
+	require.NoError(t, s.index.mmap.Flush())
+	_, err = s.store.file.Write([]byte{frameVersion1, 0, 0, 0})
+	require.NoError(t, err)
+
+	s, err = NewSegment(dir, 16, config)
+	require.NoError(t, err)
+	r, err := s.recover(true)
+	require.NoError(t, err)
+	require.True(t, r.repaired())
+	require.Equal(t, uint64(4), r.truncatedBytes)
+	require.Equal(t, uint64(19), s.nextOffset)
+
+	off, err := s.Append(wantRecord)
+	require.NoError(t, err)
+	require.Equal(t, uint64(19), off)
+	for off := uint64(16); off < 20; off++ {
+		got, err := s.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, got.Offset)
+	}
+
+	// A clean segment needs no repairs
+	require.NoError(t, s.Close())
+	s, err = NewSegment(dir, 16, config)
+	require.NoError(t, err)
+	r, err = s.recover(true)
+	require.NoError(t, err)
+	require.False(t, r.repaired())
+	require.Equal(t, uint64(20), s.nextOffset)
+}
+
+func TestSegmentRecoverCorruptRecord(t *testing.T) {
+	for name, interval := range map[string]uint64{"dense": 0, "sparse": 100} {
+		t.Run(name, func(t *testing.T) {
+			dir, _ := os.MkdirTemp("", "segment-corrupt-test")
+			defer os.RemoveAll(dir)
+
+			config := Config{}
+			config.Segment.MaxStoreBytes = 1024
+			config.Segment.MaxIndexBytes = 1024
+			config.Index.IntervalRecords = interval
+			s, err := NewSegment(dir, 16, config)
+			require.NoError(t, err)
+			var positions []uint64
+			for i := 0; i < 6; i++ {
+				positions = append(positions, s.store.size)
+				_, err := s.Append(&v1.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+				require.NoError(t, err)
+			}
+			// Only the first record made it into the index before the crash,
+			// and the third one got damaged
+			require.NoError(t, s.store.buf.Flush())
+			s.index.truncate(1)
+			require.NoError(t, s.index.mmap.Flush())
+			size := s.store.size
+			b, err := os.ReadFile(s.store.Name())
+			require.NoError(t, err)
+			b[positions[2]+frameHeaderWidth+2] ^= 0x10
+			require.NoError(t, os.WriteFile(s.store.Name(), b, 0644))
+
+			s, err = NewSegment(dir, 16, config)
+			require.NoError(t, err)
+			defer s.Close()
+			r, err := s.recover(true)
+			require.NoError(t, err)
+			require.Equal(t, positions[3]-positions[2], r.corruptBytes)
+			require.Zero(t, r.truncatedBytes)
+			require.Equal(t, size, s.store.size)
+			require.Equal(t, uint64(22), s.nextOffset)
+			for i := 0; i < 6; i++ {
+				record, err := s.Read(16 + uint64(i))
+				if i == 2 {
+					var corrupt *ErrCorruptRecord
+					require.ErrorAs(t, err, &corrupt)
+					continue
+				}
+				require.NoError(t, err)
+				require.Equal(t, fmt.Sprintf("record %d", i), string(record.Value))
+			}
+		})
+	}
+}
+
+func TestSegmentRebuildMissingIndex(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "segment-rebuild-test")
+	defer os.RemoveAll(dir)
+
+	config := Config{}
+	config.Segment.MaxStoreBytes = 1024
+	config.Segment.MaxIndexBytes = 1024
+	s, err := NewSegment(dir, 16, config)
+	require.NoError(t, err)
+
+	wantRecord := &v1.Record{Value: []byte("hello world")}
+	for i := 0; i < 3; i++ {
+		_, err := s.Append(wantRecord)
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.Close())
+	require.NoError(t, os.Remove(s.index.Name()))
+
+	s, err = NewSegment(dir, 16, config)
+	require.NoError(t, err)
+	require.Equal(t, uint64(19), s.nextOffset)
+	for off := uint64(16); off < 19; off++ {
+		got, err := s.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, got.Offset)
+		require.Equal(t, wantRecord.Value, got.Value)
+	}
+}
+
+func TestSegmentRecordFits(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "segment-fits-test")
+	defer os.RemoveAll(dir)
+
+	config := Config{}
+	config.Segment.MaxStoreBytes = 120
+	config.Segment.MaxIndexBytes = 1024
+	s, err := NewSegment(dir, 0, config)
+	require.NoError(t, err)
+
+	// A record larger than the whole store is never written
+	_, err = s.Append(&v1.Record{Value: make([]byte, 200)})
+	require.ErrorIs(t, err, ErrRecordTooLarge)
+	require.Equal(t, uint64(0), s.store.size)
+
+	// Records are checked before they are written, the store never grows
+	// past MaxStoreBytes
+	record := &v1.Record{Value: make([]byte, 20)}
+	for err = nil; err == nil; {
+		_, err = s.Append(record)
+		require.LessOrEqual(t, s.store.size, config.Segment.MaxStoreBytes)
+	}
+	require.ErrorIs(t, err, ErrSegmentFull)
+	require.False(t, s.IsMaxed())
+	require.Equal(t, uint64(2), s.nextOffset)
+
+	// Records with a frame of their own go in until one doesn't fit
+	n, err := s.appendUpTo([]*v1.Record{{Value: []byte("x")}, {Value: make([]byte, 20)}})
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.LessOrEqual(t, s.store.size, config.Segment.MaxStoreBytes)
+}
+
+func TestSegmentAppendBatch(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "segment-batch-test")
+	defer os.RemoveAll(dir)
+
+	config := Config{}
+	config.Segment.MaxStoreBytes = 1024
+	config.Segment.MaxIndexBytes = entryWidth * 4
+	s, err := NewSegment(dir, 16, config)
+	require.NoError(t, err)
+
+	batch := []*v1.Record{
+		{Value: []byte("first")},
+		{Value: []byte("second")},
+		{Value: []byte("third")},
+	}
+	first, err := s.AppendBatch(batch)
+	require.NoError(t, err)
+	require.Equal(t, uint64(16), first)
+	for i, want := range batch {
+		got, err := s.Read(first + uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, want.Value, got.Value)
+	}
+
+	// Only one more entry fits in the index, so none of the batch is written
+	size := s.store.size
+	_, err = s.AppendBatch(batch[:2])
+	require.ErrorIs(t, err, ErrSegmentFull)
+	require.Equal(t, size, s.store.size)
+	require.Equal(t, uint64(19), s.nextOffset)
+
+	// A crash in the middle of writing a batch drops the whole batch
+	require.NoError(t, s.Close())
+	config.Segment.MaxIndexBytes = 1024
+	s, err = NewSegment(dir, 16, config)
+	require.NoError(t, err)
+	_, err = s.AppendBatch(batch)
+	require.NoError(t, err)
+	require.NoError(t, s.store.buf.Flush())
+	require.NoError(t, s.store.file.Truncate(int64(s.store.size-1)))
+
+	s, err = NewSegment(dir, 16, config)
+	require.NoError(t, err)
+	r, err := s.recover(true)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), r.droppedEntries)
+	require.Equal(t, size, s.store.size)
+	require.Equal(t, uint64(19), s.nextOffset)
+}
+
+func TestSegmentRecordTimestamps(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "segment-timestamp-test")
+	defer os.RemoveAll(dir)
+
+	config := Config{}
+	config.Segment.MaxStoreBytes = 1024
+	config.Segment.MaxIndexBytes = 1024
+	s, err := NewSegment(dir, 0, config)
+	require.NoError(t, err)
+
+	want := &v1.Record{
+		Value:     []byte("hello world"),
+		Key:       []byte("key"),
+		Headers:   []*v1.Header{{Key: "content-type", Value: []byte("text/plain")}},
+		Timestamp: 1000,
+	}
+	before := time.Now().UnixMilli()
+	off, err := s.Append(want)
+	require.NoError(t, err)
+	got, err := s.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, want.Key, got.Key)
+	require.Equal(t, "content-type", got.Headers[0].Key)
+	require.Equal(t, []byte("text/plain"), got.Headers[0].Value)
+	// The log stamps records with the append time by default
+	require.GreaterOrEqual(t, got.Timestamp, before)
+
+	s.config.Timestamps.UseProducerTime = true
+	off, err = s.Append(&v1.Record{Value: []byte("produced"), Timestamp: 1000})
+	require.NoError(t, err)
+	got, err = s.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, int64(1000), got.Timestamp)
+
+	// Records without a producer timestamp still get the append time
+	off, err = s.Append(&v1.Record{Value: []byte("unstamped")})
+	require.NoError(t, err)
+	got, err = s.Read(off)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, got.Timestamp, before)
+}
+
+func TestSegmentTruncateAfter(t *testing.T) {
+	for name, perBatch := range map[string]bool{"linked frames": false, "batch frame": true} {
+		t.Run(name, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "segment-truncate-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			config := Config{}
+			config.Segment.MaxStoreBytes = 1024
+			config.Segment.MaxIndexBytes = 1024
+			if perBatch {
+				config.Compression.Codec = Gzip
+				config.Compression.PerBatch = true
+			}
+			s, err := NewSegment(dir, 0, config)
+			require.NoError(t, err)
+			_, err = s.Append(&v1.Record{Value: []byte("0")})
+			require.NoError(t, err)
+			_, err = s.AppendBatch([]*v1.Record{{Value: []byte("1")}, {Value: []byte("2")}, {Value: []byte("3")}})
+			require.NoError(t, err)
+			require.NoError(t, s.Seal())
+
+			// The batch is cut in the middle
+			require.NoError(t, s.TruncateAfter(1))
+			require.Equal(t, uint64(2), s.nextOffset)
+			_, err = s.Read(2)
+			require.Error(t, err)
+			off, err := s.Append(&v1.Record{Value: []byte("new 2")})
+			require.NoError(t, err)
+			require.Equal(t, uint64(2), off)
+
+			// What's left is intact after a restart
+			require.NoError(t, s.Close())
+			s, err = NewSegment(dir, 0, config)
+			require.NoError(t, err)
+			defer s.Close()
+			r, err := s.recover(true)
+			require.NoError(t, err)
+			require.False(t, r.repaired())
+			for off, want := range []string{"0", "1", "new 2"} {
+				record, err := s.Read(uint64(off))
+				require.NoError(t, err)
+				require.Equal(t, []byte(want), record.Value)
+			}
+
+			require.NoError(t, s.TruncateAfter(0))
+			require.Equal(t, uint64(1), s.nextOffset)
+
+			// A segment closed right after a batch isn't repaired either
+			_, err = s.AppendBatch([]*v1.Record{{Value: []byte("1")}, {Value: []byte("2")}})
+			require.NoError(t, err)
+			require.NoError(t, s.Close())
+			s, err = NewSegment(dir, 0, config)
+			require.NoError(t, err)
+			r, err = s.recover(true)
+			require.NoError(t, err)
+			require.False(t, r.repaired())
+		})
+	}
+}
+
+func TestSegmentSparseIndex(t *testing.T) {
+	dir, err := os.MkdirTemp("", "segment-sparse-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := Config{}
+	config.Segment.MaxStoreBytes = 4096
+	config.Segment.MaxIndexBytes = 1024
+	config.Index.IntervalRecords = 4
+	s, err := NewSegment(dir, 16, config)
+	require.NoError(t, err)
+	require.True(t, s.index.sparse)
+
+	var want []string
+	for i := 0; i < 10; i++ {
+		want = append(want, fmt.Sprintf("record %d", i))
+		_, err := s.Append(&v1.Record{Value: []byte(want[i])})
+		require.NoError(t, err)
+	}
+	batch := []*v1.Record{{Value: []byte("a")}, {Value: []byte("b")}, {Value: []byte("c")}}
+	_, err = s.AppendBatch(batch)
+	require.NoError(t, err)
+	want = append(want, "a", "b", "c")
+	// Too close to the batch for an entry of its own
+	_, err = s.Append(&v1.Record{Value: []byte("after batch")})
+	require.NoError(t, err)
+	want = append(want, "after batch")
+	require.Equal(t, uint64(16+len(want)), s.nextOffset)
+	// Records 0, 4 and 8 and the batch got an entry
+	require.Equal(t, uint64(4*entryWidth), s.index.size)
+
+	check := func(s *Segment) {
+		t.Helper()
+		for i, value := range want {
+			record, err := s.Read(16 + uint64(i))
+			require.NoError(t, err)
+			require.Equal(t, []byte(value), record.Value)
+			require.Equal(t, 16+uint64(i), record.Offset)
+		}
+		_, err := s.Read(16 + uint64(len(want)))
+		require.Error(t, err)
+	}
+	check(s)
+
+	// The next offset and the entries survive a crash
+	require.NoError(t, s.store.buf.Flush())
+	require.NoError(t, s.index.mmap.Flush())
+	s, err = NewSegment(dir, 16, config)
+	require.NoError(t, err)
+	require.Equal(t, uint64(16+len(want)), s.nextOffset)
+	r, err := s.recover(true)
+	require.NoError(t, err)
+	require.False(t, r.repaired())
+	require.Equal(t, uint64(4*entryWidth), s.index.size)
+	check(s)
+
+	// Truncating between two entries keeps the one before
+	require.NoError(t, s.TruncateAfter(16+5))
+	want = want[:6]
+	require.Equal(t, uint64(16+len(want)), s.nextOffset)
+	require.Equal(t, uint64(2*entryWidth), s.index.size)
+	check(s)
+	require.NoError(t, s.Close())
+
+	// Opening it dense rebuilds an entry for every record
+	config.Index.IntervalRecords = 0
+	s, err = NewSegment(dir, 16, config)
+	require.NoError(t, err)
+	defer s.Close()
+	require.False(t, s.index.sparse)
+	require.Equal(t, uint64(len(want))*entryWidth, s.index.size)
+	check(s)
+}
@@ -5,21 +5,81 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
 	"sync"
+	"sync/atomic"
+
+	mmap "github.com/edsrzf/mmap-go"
 )
 
-const lenWidth = 8
+// Every record in the store is written as a frame:
+//
+//	| version (1) | flags (1) | length (6) | crc32c (4) | payload (length) |
+//
+// The flags tell whether the frame is part of a batch and whether its payload
+// is compressed and encrypted, see compression.go and encryption.go.
+// The checksum covers the first 8 bytes of the header and the payload.
+// Stores written before checksums were introduced hold legacy frames, which
+// are a plain 8 byte big endian length followed by the payload. Since no
+// legacy record is 2^56 bytes long, their first byte is always 0, which is
+// how the two are told apart on read.
+const (
+	lenWidth         = 8
+	crcWidth         = 4
+	frameHeaderWidth = lenWidth + crcWidth
+
+	frameLegacy   byte = 0x00
+	frameVersion1 byte = 0x81
+
+	frameLenMask = 1<<48 - 1
+
+	// frameFlagContinued marks a frame followed by another one of the same
+	// atomic batch
+	frameFlagContinued byte = 1 << 0
+	// frameFlagBatch marks a frame holding several records
+	frameFlagBatch byte = 1 << 1
+)
 
 var (
-	enc = binary.BigEndian
+	enc      = binary.BigEndian
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
 )
 
+var errStoreSealed = errors.New("store is sealed")
+
+// frame is a record read back from the store along with its framing
+type frame struct {
+	version byte
+	flags   byte
+	payload []byte
+	// width is the number of bytes the frame occupies in the store
+	width uint64
+}
+
 type store struct {
 	file *os.File
 	mu   sync.Mutex
 	buf  *bufio.Writer
 	size uint64
+	// sealed maps the store read-only once it's no longer appended to, its
+	// reads then skip the lock, the flush and the syscalls
+	sealed atomic.Pointer[mmap.MMap]
+}
+
+// mapped reads a sealed store
+type mapped []byte
+
+func (m mapped) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(m)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
 }
 
 func newStore(f *os.File) (*store, error) {
@@ -42,6 +102,9 @@ func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 	if s.file == nil {
 		return 0, 0, errors.New("file is nil")
 	}
+	if s.sealed.Load() != nil {
+		return 0, 0, errStoreSealed
+	}
 
 	// Check if file is closed
 	_, err = s.file.Stat()
@@ -49,23 +112,86 @@ func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 		return 0, 0, fmt.Errorf("log file is closed or inaccessible: %w", err)
 	}
 
+	if uint64(len(p)) > frameLenMask {
+		return 0, 0, fmt.Errorf("record of %d bytes does not fit in a frame: %w", len(p), ErrRecordTooLarge)
+	}
+
 	pos = s.size
-	// write the length of the record first
-	if err := binary.Write(s.buf, enc, uint64(len(p))); err != nil {
+	// write the header first, then the record itself
+	if _, err := s.buf.Write(encodeFrameHeader(0, p)); err != nil {
 		return 0, 0, err
 	}
-	// write the record itself
 	w, err := s.buf.Write(p)
 	if err != nil {
 		return 0, 0, err
 	}
-	// add the length of the record to the size
-	w += lenWidth
+	// add the length of the header to the size
+	w += frameHeaderWidth
 	s.size += uint64(w)
 	return uint64(w), pos, nil
 }
 
+// AppendBatch appends the records with a single write and returns the
+// position of each of them, every frame gets the flags. Linked records are
+// flagged so a crash in the middle of writing them can be told apart from
+// separate appends.
+func (s *store) AppendBatch(ps [][]byte, flags byte, linked bool) (n uint64, pos []uint64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return 0, nil, errors.New("file is nil")
+	}
+	if s.sealed.Load() != nil {
+		return 0, nil, errStoreSealed
+	}
+
+	var size int
+	for _, p := range ps {
+		if uint64(len(p)) > frameLenMask {
+			return 0, nil, fmt.Errorf("record of %d bytes does not fit in a frame: %w", len(p), ErrRecordTooLarge)
+		}
+		size += frameHeaderWidth + len(p)
+	}
+	buf := make([]byte, 0, size)
+	pos = make([]uint64, len(ps))
+	for i, p := range ps {
+		pos[i] = s.size + uint64(len(buf))
+		f := flags
+		if linked && i < len(ps)-1 {
+			f |= frameFlagContinued
+		}
+		buf = append(buf, encodeFrameHeader(f, p)...)
+		buf = append(buf, p...)
+	}
+	w, err := s.buf.Write(buf)
+	if err != nil {
+		return 0, nil, err
+	}
+	s.size += uint64(w)
+	return uint64(w), pos, nil
+}
+
+// encodeFrameHeader returns the version 1 header for the payload p
+func encodeFrameHeader(flags byte, p []byte) []byte {
+	header := make([]byte, frameHeaderWidth)
+	enc.PutUint64(header[:lenWidth], uint64(len(p)))
+	header[0] = frameVersion1
+	header[1] = flags
+	crc := crc32.Update(0, crcTable, header[:lenWidth])
+	crc = crc32.Update(crc, crcTable, p)
+	enc.PutUint32(header[lenWidth:], crc)
+	return header
+}
+
 func (s *store) Read(pos uint64) ([]byte, error) {
+	if m := s.sealed.Load(); m != nil {
+		f, err := s.readFrame(mapped(*m), pos)
+		if err != nil {
+			return nil, err
+		}
+		return f.payload, nil
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -78,23 +204,85 @@ func (s *store) Read(pos uint64) ([]byte, error) {
 	if err := s.buf.Flush(); err != nil {
 		return nil, err
 	}
-	buf := make([]byte, lenWidth)
-	// read the length of the record
-	if _, err := s.file.ReadAt(buf, int64(pos)); err != nil {
+	f, err := s.readFrame(s.file, pos)
+	if err != nil {
+		return nil, err
+	}
+	return f.payload, nil
+}
+
+// ReadFrame reads the frame at the given position
+func (s *store) ReadFrame(pos uint64) (*frame, error) {
+	if m := s.sealed.Load(); m != nil {
+		return s.readFrame(mapped(*m), pos)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
 		return nil, err
 	}
-	n := enc.Uint64(buf)
-	// create a buffer to hold the record
-	buf = make([]byte, n)
-	// read the record itself
-	if _, err := s.file.ReadAt(buf, int64(pos+lenWidth)); err != nil {
+	return s.readFrame(s.file, pos)
+}
+
+// readFrame reads and verifies the frame at pos from r. Unless the store is
+// sealed the caller must hold the lock and have flushed the buffer.
+func (s *store) readFrame(r io.ReaderAt, pos uint64) (*frame, error) {
+	if pos >= s.size {
+		return nil, io.EOF
+	}
+	header := make([]byte, lenWidth)
+	// read the length word, which also tells which frame version this is
+	if _, err := r.ReadAt(header, int64(pos)); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, s.corrupt(pos, "truncated frame header")
+		}
 		return nil, err
 	}
-	return buf, nil
+	f := &frame{version: header[0]}
+	switch f.version {
+	case frameLegacy:
+		n := enc.Uint64(header)
+		if n > s.size-pos-lenWidth {
+			return nil, s.corrupt(pos, "record extends past the end of the store")
+		}
+		f.payload = make([]byte, n)
+		if _, err := r.ReadAt(f.payload, int64(pos+lenWidth)); err != nil {
+			return nil, err
+		}
+		f.width = lenWidth + n
+	case frameVersion1:
+		f.flags = header[1]
+		n := enc.Uint64(header) & frameLenMask
+		if pos+frameHeaderWidth > s.size || n > s.size-pos-frameHeaderWidth {
+			return nil, s.corrupt(pos, "record extends past the end of the store")
+		}
+		// read the checksum and the record in one go
+		buf := make([]byte, crcWidth+n)
+		if _, err := r.ReadAt(buf, int64(pos+lenWidth)); err != nil {
+			return nil, err
+		}
+		crc := crc32.Update(0, crcTable, header)
+		crc = crc32.Update(crc, crcTable, buf[crcWidth:])
+		if crc != enc.Uint32(buf[:crcWidth]) {
+			return nil, s.corrupt(pos, "checksum mismatch")
+		}
+		f.payload = buf[crcWidth:]
+		f.width = frameHeaderWidth + n
+	default:
+		return nil, s.corrupt(pos, fmt.Sprintf("unknown frame version %#x", f.version))
+	}
+	return f, nil
+}
+
+func (s *store) corrupt(pos uint64, reason string) error {
+	return &ErrCorruptRecord{Segment: s.file.Name(), Pos: pos, Reason: reason}
 }
 
 // ReadAt reads the record at the given position
 func (s *store) ReadAt(buffer []byte, startPosition int64) (int, error) {
+	if m := s.sealed.Load(); m != nil {
+		return mapped(*m).ReadAt(buffer, startPosition)
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -110,10 +298,99 @@ func (s *store) ReadAt(buffer []byte, startPosition int64) (int, error) {
 	return s.file.ReadAt(buffer, startPosition)
 }
 
+// Flush writes the buffered records to the file
+func (s *store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.Flush()
+}
+
+// Sync writes the buffered records to the file and syncs it to disk
+func (s *store) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+// Truncate cuts the store down to size bytes
+func (s *store) Truncate(size uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	// A sealed store is mapped again at its new size
+	sealed, err := s.unseal()
+	if err != nil {
+		return err
+	}
+	if err := s.file.Truncate(int64(size)); err != nil {
+		return err
+	}
+	s.size = size
+	if sealed {
+		return s.seal()
+	}
+	return nil
+}
+
+// Seal maps the store read-only, it can't be appended to anymore. Reads of a
+// sealed store don't take its lock, so the caller must make sure none are in
+// flight when it's closed.
+func (s *store) Seal() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sealed.Load() != nil {
+		return nil
+	}
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	return s.seal()
+}
+
+// Unseal unmaps a sealed store so it can be appended to again
+func (s *store) Unseal() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.unseal()
+	return err
+}
+
+// seal maps the store, the caller must hold the lock
+func (s *store) seal() error {
+	// An empty file can't be mapped, reading it needs no lock anyway
+	if s.size == 0 {
+		return nil
+	}
+	m, err := mmap.Map(s.file, mmap.RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	s.sealed.Store(&m)
+	return nil
+}
+
+// unseal unmaps a sealed store and reports whether it was sealed, the caller
+// must hold the lock
+func (s *store) unseal() (bool, error) {
+	m := s.sealed.Swap(nil)
+	if m == nil {
+		return false, nil
+	}
+	return true, m.Unmap()
+}
+
 // Close closes the store and flushes any buffered data to the underlying file
 func (s *store) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if _, err := s.unseal(); err != nil {
+		return err
+	}
 	if err := s.buf.Flush(); err != nil {
 		return err
 	}
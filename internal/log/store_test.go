@@ -1,6 +1,7 @@
 package log
 
 import (
+	"encoding/binary"
 	"os"
 	"testing"
 
@@ -24,9 +25,9 @@ func TestStoreAppendRead(t *testing.T) {
 	for _, data := range testData {
 		n, pos, err := s.Append(data)
 		require.NoError(t, err)
-		require.Equal(t, uint64(len(data)+lenWidth), n)
+		require.Equal(t, uint64(len(data)+frameHeaderWidth), n)
 		require.Equal(t, expectedPos, pos)
-		expectedPos += uint64(lenWidth) + uint64(len(data))
+		expectedPos += uint64(frameHeaderWidth) + uint64(len(data))
 
 		read, err := s.Read(pos)
 		require.NoError(t, err)
@@ -47,7 +48,7 @@ func TestStoreReadAt(t *testing.T) {
 	require.NoError(t, err)
 
 	readData := make([]byte, len(testData))
-	n, err := s.ReadAt(readData, int64(pos+lenWidth))
+	n, err := s.ReadAt(readData, int64(pos+frameHeaderWidth))
 	require.NoError(t, err)
 	require.Equal(t, len(testData), n)
 	require.Equal(t, testData, readData)
@@ -117,3 +118,104 @@ func TestNewStore(t *testing.T) {
 	require.NotNil(t, s.buf)
 	require.Equal(t, uint64(0), s.size)
 }
+
+func TestStoreCorruptRecord(t *testing.T) {
+	f, err := os.CreateTemp("", "store_corrupt_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+
+	_, pos, err := s.Append([]byte("hello world"))
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	// Flip a bit in the record
+	b, err := os.ReadFile(f.Name())
+	require.NoError(t, err)
+	b[pos+frameHeaderWidth] ^= 0x01
+	require.NoError(t, os.WriteFile(f.Name(), b, 0o666))
+
+	f, err = os.OpenFile(f.Name(), os.O_RDWR, 0o666)
+	require.NoError(t, err)
+	s, err = newStore(f)
+	require.NoError(t, err)
+	defer s.Close()
+
+	_, err = s.Read(pos)
+	var corrupt *ErrCorruptRecord
+	require.ErrorAs(t, err, &corrupt)
+	require.Equal(t, pos, corrupt.Pos)
+	require.Equal(t, f.Name(), corrupt.Segment)
+}
+
+func TestStoreReadLegacyFrames(t *testing.T) {
+	f, err := os.CreateTemp("", "store_legacy_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	// Write a record the way stores did before frames carried checksums
+	legacy := []byte("legacy data")
+	require.NoError(t, binary.Write(f, enc, uint64(len(legacy))))
+	_, err = f.Write(legacy)
+	require.NoError(t, err)
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	defer s.Close()
+
+	// New records are appended after the legacy one and both can be read
+	_, pos, err := s.Append([]byte("new data"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(lenWidth+len(legacy)), pos)
+
+	read, err := s.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, legacy, read)
+
+	read, err = s.Read(pos)
+	require.NoError(t, err)
+	require.Equal(t, []byte("new data"), read)
+}
+
+func TestStoreSeal(t *testing.T) {
+	f, err := os.CreateTemp("", "store_seal_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	var positions []uint64
+	for _, data := range []string{"hello world", "foo bar", "test data"} {
+		_, pos, err := s.Append([]byte(data))
+		require.NoError(t, err)
+		positions = append(positions, pos)
+	}
+	require.NoError(t, s.Seal())
+	require.NotNil(t, s.sealed.Load())
+
+	// Sealed stores are read from the mapping and can't be appended to
+	read, err := s.Read(positions[1])
+	require.NoError(t, err)
+	require.Equal(t, []byte("foo bar"), read)
+	b := make([]byte, 7)
+	n, err := s.ReadAt(b, int64(positions[1]+frameHeaderWidth))
+	require.NoError(t, err)
+	require.Equal(t, 7, n)
+	require.Equal(t, []byte("foo bar"), b)
+	_, _, err = s.Append([]byte("more"))
+	require.Error(t, err)
+
+	// Truncating maps the rest again
+	require.NoError(t, s.Truncate(positions[2]))
+	require.NotNil(t, s.sealed.Load())
+	_, err = s.Read(positions[2])
+	require.Error(t, err)
+	read, err = s.Read(positions[0])
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), read)
+
+	require.NoError(t, s.Close())
+	require.Nil(t, s.sealed.Load())
+}
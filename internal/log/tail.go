@@ -0,0 +1,51 @@
+package log
+
+import "context"
+
+// WaitFor blocks until the record at the offset has been appended and is as
+// durable as Config.Durability asks for, or ctx is done. It returns
+// ErrLogClosed when the log is closed in the meantime.
+func (l *Log) WaitFor(ctx context.Context, offset uint64) error {
+	l.mu.RLock()
+	durable := l.syncer.durable
+	l.mu.RUnlock()
+	return durable.wait(ctx, offset)
+}
+
+// HighWatermark returns the offset after the last durable record, every
+// record below it can be read and survives a crash
+func (l *Log) HighWatermark() uint64 {
+	l.mu.RLock()
+	durable := l.syncer.durable
+	l.mu.RUnlock()
+	durable.mu.Lock()
+	defer durable.mu.Unlock()
+	return durable.next
+}
+
+// NextContext is Next for tailing a log: at the end of the log it waits for
+// more records to be appended instead of returning false. When ctx is done
+// it returns false and Err returns the context error, the iterator can then
+// still be used with another context.
+func (it *Iterator) NextContext(ctx context.Context) bool {
+	for {
+		if it.Next() {
+			return true
+		}
+		if it.closed || it.err != nil {
+			return false
+		}
+		if err := ctx.Err(); err != nil {
+			it.waitErr = err
+			return false
+		}
+		if err := it.log.WaitFor(ctx, it.next); err != nil {
+			if ctx.Err() == nil {
+				// The log was closed under the iterator
+				it.err = err
+			}
+			it.waitErr = err
+			return false
+		}
+	}
+}
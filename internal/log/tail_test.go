@@ -0,0 +1,105 @@
+package log
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	v1 "github.com/adityavit/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWaitFor(t *testing.T) {
+	log := newIteratorLog(t, Config{}, 2)
+	require.Equal(t, uint64(2), log.HighWatermark())
+
+	// Records already appended don't block
+	require.NoError(t, log.WaitFor(context.Background(), 1))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, log.WaitFor(ctx, 2), context.DeadlineExceeded)
+
+	done := make(chan error)
+	go func() {
+		done <- log.WaitFor(context.Background(), 2)
+	}()
+	_, err := log.Append(&v1.Record{Value: []byte("record 2")})
+	require.NoError(t, err)
+	require.NoError(t, <-done)
+
+	// Closing the log wakes up the waiters
+	go func() {
+		done <- log.WaitFor(context.Background(), 10)
+	}()
+	require.NoError(t, log.Close())
+	require.ErrorIs(t, <-done, ErrLogClosed)
+}
+
+func TestIteratorNextContext(t *testing.T) {
+	log := newIteratorLog(t, Config{}, 3)
+	it := log.Iterator(1)
+	defer it.Close()
+
+	appended := make(chan error, 1)
+	go func() {
+		for i := 3; i < 6; i++ {
+			time.Sleep(time.Millisecond)
+			if _, err := log.Append(&v1.Record{Value: []byte(fmt.Sprintf("record %d", i))}); err != nil {
+				appended <- err
+				return
+			}
+		}
+		appended <- nil
+	}()
+	for want := uint64(1); want < 6; want++ {
+		require.True(t, it.NextContext(context.Background()))
+		require.Equal(t, want, it.Record().Offset)
+	}
+	require.NoError(t, <-appended)
+
+	// Giving up waiting doesn't stop the iterator
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.False(t, it.NextContext(ctx))
+	require.ErrorIs(t, it.Err(), context.DeadlineExceeded)
+	_, err := log.Append(&v1.Record{Value: []byte("record 6")})
+	require.NoError(t, err)
+	require.True(t, it.NextContext(context.Background()))
+	require.Equal(t, uint64(6), it.Record().Offset)
+	require.NoError(t, it.Err())
+}
+
+func TestIteratorNextContextCompacted(t *testing.T) {
+	config := Config{}
+	// Every record fills up a segment of its own
+	config.Segment.MaxIndexBytes = entryWidth
+	config.Timestamps.UseProducerTime = true
+	config.Compaction.DeleteRetention = time.Hour
+	log := newTestLog(t, config)
+	t.Cleanup(func() { log.Close() })
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&v1.Record{Key: []byte("k"), Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	old := time.Now().Add(-2 * time.Hour).UnixMilli()
+	_, err := log.Append(&v1.Record{Key: []byte("k"), Timestamp: old})
+	require.NoError(t, err)
+	// The tombstone takes all the records with it, leaving nothing but gaps
+	// before the empty active segment
+	require.NoError(t, log.Compact())
+
+	it := log.Iterator(0)
+	defer it.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	require.False(t, it.NextContext(ctx))
+	require.ErrorIs(t, it.Err(), context.DeadlineExceeded)
+	require.Equal(t, uint64(6), it.Offset())
+
+	_, err = log.Append(&v1.Record{Value: []byte("record 6")})
+	require.NoError(t, err)
+	require.True(t, it.NextContext(context.Background()))
+	require.Equal(t, uint64(6), it.Record().Offset)
+}
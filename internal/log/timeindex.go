@@ -0,0 +1,288 @@
+// Create a time index file that stores the largest timestamp seen so far in a
+// segment and the offset of the record that carried it
+
+package log
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+
+	mmap "github.com/edsrzf/mmap-go"
+)
+
+// The time index file starts with a header followed by the entries:
+//
+//	| magic (4) | version (1) | entry width (1) | reserved (2) |
+//	| timestamp (8) | relative offset (8) | ...
+//
+// Time indexes written before the header was introduced hold entries with a 4
+// byte relative offset and no header, they are rebuilt from the store.
+const (
+	timeIndexMagic            = "PLTI"
+	timeIndexVersion1    byte = 1
+	timeIndexHeaderWidth      = 8
+	timestampWidth            = 8
+	timeIndexEntryWidth       = timestampWidth + offsetWidth
+)
+
+type timeIndex struct {
+	file *os.File
+	mmap mmap.MMap
+	// data is the part of the mapping after the header
+	data []byte
+	// size is the number of bytes of entries written
+	size uint64
+	// readOnly is set for a time index mapped read-only, it's never written
+	readOnly bool
+}
+
+// newTimeIndex opens a time index with room for MaxIndexBytes of entries, or
+// as many as it already holds when it was written with a larger limit. A time
+// index in the legacy format is emptied, the segment rebuilds it.
+func newTimeIndex(f *os.File, c Config) (*timeIndex, error) {
+	idx := &timeIndex{
+		file: f,
+	}
+	fi, err := os.Stat(f.Name())
+	if err != nil {
+		return nil, err
+	}
+	size := uint64(fi.Size())
+	if size > 0 {
+		header := make([]byte, min(size, timeIndexHeaderWidth))
+		if _, err := f.ReadAt(header, 0); err != nil {
+			return nil, err
+		}
+		if !bytes.HasPrefix(header, []byte(timeIndexMagic)) {
+			size = 0
+		} else if err := checkTimeIndexHeader(header); err != nil {
+			return nil, fmt.Errorf("opening time index %s: %w", fi.Name(), err)
+		}
+	}
+	if size > timeIndexHeaderWidth {
+		idx.size = size - timeIndexHeaderWidth
+	}
+	// A dense index has an entry for every record, which adds at most one
+	// entry here, so this is enough room until a sparse index runs past it
+	capacity := timeIndexHeaderWidth + max(c.Segment.MaxIndexBytes, idx.size)
+	if size == 0 {
+		// Drop the entries of a legacy time index
+		if err := os.Truncate(f.Name(), 0); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.Truncate(f.Name(), int64(capacity)); err != nil {
+		return nil, err
+	}
+	idx.mmap, err = mmap.Map(f, mmap.RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	idx.data = idx.mmap[timeIndexHeaderWidth:]
+	if size == 0 {
+		idx.writeHeader()
+	}
+	idx.countWritten()
+	return idx, nil
+}
+
+// writeHeader writes the header of the current format
+func (i *timeIndex) writeHeader() {
+	copy(i.mmap, timeIndexMagic)
+	i.mmap[len(timeIndexMagic)] = timeIndexVersion1
+	i.mmap[len(timeIndexMagic)+1] = timeIndexEntryWidth
+}
+
+// checkTimeIndexHeader returns an error unless the header is of a format this
+// version reads
+func checkTimeIndexHeader(header []byte) error {
+	if len(header) < timeIndexHeaderWidth {
+		return fmt.Errorf("truncated header")
+	}
+	version, width := header[len(timeIndexMagic)], header[len(timeIndexMagic)+1]
+	if version != timeIndexVersion1 || width != timeIndexEntryWidth {
+		return fmt.Errorf("unsupported version %d with %d byte entries", version, width)
+	}
+	return nil
+}
+
+// openTimeIndexReadOnly maps a time index read-only as it is, a missing one,
+// one without a header yet or one in the legacy format has no entries
+func openTimeIndexReadOnly(name string) (*timeIndex, error) {
+	idx := &timeIndex{readOnly: true}
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return idx, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	idx.file = f
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if fi.Size() < timeIndexHeaderWidth+timeIndexEntryWidth {
+		return idx, nil
+	}
+	header := make([]byte, timeIndexHeaderWidth)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !bytes.HasPrefix(header, []byte(timeIndexMagic)) {
+		return idx, nil
+	}
+	if err := checkTimeIndexHeader(header); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("opening time index %s: %w", fi.Name(), err)
+	}
+	if idx.mmap, err = mmap.Map(f, mmap.RDONLY, 0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	idx.data = idx.mmap[timeIndexHeaderWidth:]
+	idx.size = uint64(len(idx.data))
+	idx.countWritten()
+	return idx, nil
+}
+
+// countWritten sets the size to the entries that were written. After a crash,
+// or while a writer has it open, the file still has room for more entries and
+// the written entries end at the first zeroed one as no timestamp is 0.
+func (i *timeIndex) countWritten() {
+	capacity := min(i.size, uint64(len(i.data))) / timeIndexEntryWidth
+	written := sort.Search(int(capacity), func(j int) bool {
+		ts, _ := i.entry(uint64(j))
+		return ts == 0
+	})
+	i.size = uint64(written) * timeIndexEntryWidth
+}
+
+func (i *timeIndex) Close() error {
+	if i.readOnly {
+		if i.mmap != nil {
+			if err := i.mmap.Unmap(); err != nil {
+				return err
+			}
+		}
+		if i.file == nil {
+			return nil
+		}
+		return i.file.Close()
+	}
+	if err := i.mmap.Flush(); err != nil {
+		return err
+	}
+	if err := i.mmap.Unmap(); err != nil {
+		return err
+	}
+	if err := i.file.Sync(); err != nil {
+		return err
+	}
+	if err := i.file.Truncate(int64(timeIndexHeaderWidth + i.size)); err != nil {
+		return err
+	}
+	return i.file.Close()
+}
+
+// Sync writes the mapped entries back to the file
+func (i *timeIndex) Sync() error {
+	return i.mmap.Flush()
+}
+
+// Write records that the record at the relative offset carries the largest
+// timestamp of the segment so far, smaller timestamps are skipped
+func (i *timeIndex) Write(timestamp int64, offset uint64) error {
+	if maxTimestamp, ok := i.MaxTimestamp(); ok && timestamp <= maxTimestamp {
+		return nil
+	}
+	if uint64(len(i.data)) < i.size+timeIndexEntryWidth {
+		if err := i.grow(); err != nil {
+			return err
+		}
+	}
+	binary.BigEndian.PutUint64(i.data[i.size:i.size+timestampWidth], uint64(timestamp))
+	binary.BigEndian.PutUint64(i.data[i.size+timestampWidth:i.size+timeIndexEntryWidth], offset)
+	i.size += timeIndexEntryWidth
+	return nil
+}
+
+// grow doubles the room for entries. A sparse index leaves most records of a
+// segment without an entry, so the segment fills up long after every record
+// with a new largest timestamp used up the room sized after the index.
+func (i *timeIndex) grow() error {
+	size := timeIndexHeaderWidth + max(2*len(i.data), timeIndexEntryWidth)
+	if err := i.file.Truncate(int64(size)); err != nil {
+		return err
+	}
+	m, err := mmap.Map(i.file, mmap.RDWR, 0)
+	if err != nil {
+		return err
+	}
+	if err := i.mmap.Unmap(); err != nil {
+		m.Unmap()
+		return err
+	}
+	i.mmap = m
+	i.data = m[timeIndexHeaderWidth:]
+	return nil
+}
+
+// Lookup returns the relative offset of the first record with a timestamp at
+// or after the given one
+func (i *timeIndex) Lookup(timestamp int64) (uint64, bool) {
+	n := i.entries()
+	j := sort.Search(int(n), func(j int) bool {
+		ts, _ := i.entry(uint64(j))
+		return ts >= timestamp
+	})
+	if uint64(j) == n {
+		return 0, false
+	}
+	_, off := i.entry(uint64(j))
+	return off, true
+}
+
+// MaxTimestamp returns the largest timestamp in the segment
+func (i *timeIndex) MaxTimestamp() (int64, bool) {
+	n := i.entries()
+	if n == 0 {
+		return 0, false
+	}
+	ts, _ := i.entry(n - 1)
+	return ts, true
+}
+
+// truncateFrom drops the entries of records at or after the relative offset
+func (i *timeIndex) truncateFrom(offset uint64) {
+	n := i.entries()
+	for n > 0 {
+		if _, off := i.entry(n - 1); off < offset {
+			break
+		}
+		n--
+	}
+	size := n * timeIndexEntryWidth
+	clear(i.data[size:i.size])
+	i.size = size
+}
+
+func (i *timeIndex) entries() uint64 {
+	return i.size / timeIndexEntryWidth
+}
+
+func (i *timeIndex) entry(n uint64) (int64, uint64) {
+	pos := n * timeIndexEntryWidth
+	ts := int64(binary.BigEndian.Uint64(i.data[pos : pos+timestampWidth]))
+	off := binary.BigEndian.Uint64(i.data[pos+timestampWidth : pos+timeIndexEntryWidth])
+	return ts, off
+}
+
+func (i *timeIndex) Name() string {
+	return i.file.Name()
+}
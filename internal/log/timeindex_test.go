@@ -0,0 +1,204 @@
+package log
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	v1 "github.com/adityavit/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeIndex(t *testing.T) {
+	f, err := os.CreateTemp("", "timeindex_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	idx, err := newTimeIndex(f, c)
+	require.NoError(t, err)
+	_, ok := idx.MaxTimestamp()
+	require.False(t, ok)
+
+	// Only timestamps larger than every one before them get an entry
+	require.NoError(t, idx.Write(100, 0))
+	require.NoError(t, idx.Write(90, 1))
+	require.NoError(t, idx.Write(200, 2))
+	require.Equal(t, uint64(2), idx.entries())
+
+	for _, tc := range []struct {
+		timestamp int64
+		off       uint64
+		ok        bool
+	}{
+		{timestamp: 50, off: 0, ok: true},
+		{timestamp: 100, off: 0, ok: true},
+		{timestamp: 150, off: 2, ok: true},
+		{timestamp: 201, ok: false},
+	} {
+		off, ok := idx.Lookup(tc.timestamp)
+		require.Equal(t, tc.ok, ok)
+		require.Equal(t, tc.off, off)
+	}
+	require.NoError(t, idx.Close())
+
+	// Test reopen
+	f, _ = os.OpenFile(f.Name(), os.O_RDWR, 0600)
+	idx, err = newTimeIndex(f, c)
+	require.NoError(t, err)
+	maxTimestamp, ok := idx.MaxTimestamp()
+	require.True(t, ok)
+	require.Equal(t, int64(200), maxTimestamp)
+
+	idx.truncateFrom(2)
+	maxTimestamp, _ = idx.MaxTimestamp()
+	require.Equal(t, int64(100), maxTimestamp)
+
+	// Offsets don't wrap at 32 bits
+	require.NoError(t, idx.Write(300, 1<<32+2))
+	off, ok := idx.Lookup(250)
+	require.True(t, ok)
+	require.Equal(t, uint64(1<<32+2), off)
+	require.NoError(t, idx.Close())
+
+	// Reopening with a smaller limit keeps every entry
+	c.Segment.MaxIndexBytes = timeIndexEntryWidth
+	f, _ = os.OpenFile(f.Name(), os.O_RDWR, 0600)
+	idx, err = newTimeIndex(f, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), idx.entries())
+	maxTimestamp, _ = idx.MaxTimestamp()
+	require.Equal(t, int64(300), maxTimestamp)
+	require.NoError(t, idx.Close())
+}
+
+func TestTimeIndexLegacy(t *testing.T) {
+	dir, err := os.MkdirTemp("", "timeindex-legacy-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := Config{}
+	config.Segment.MaxStoreBytes = 1024
+	config.Segment.MaxIndexBytes = 1024
+	config.Timestamps.UseProducerTime = true
+	s, err := NewSegment(dir, 16, config)
+	require.NoError(t, err)
+	for i := int64(1); i <= 3; i++ {
+		_, err := s.Append(&v1.Record{Value: []byte("hello"), Timestamp: i * 100})
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.Close())
+
+	// A time index without a header has 4 byte offsets, it's rebuilt from the
+	// store rather than read with the wrong entry width
+	legacy := make([]byte, 3*(timestampWidth+4))
+	for i := 0; i < 3; i++ {
+		entry := legacy[i*(timestampWidth+4):]
+		binary.BigEndian.PutUint64(entry, uint64(i+1)*100)
+		binary.BigEndian.PutUint32(entry[timestampWidth:], uint32(i))
+	}
+	require.NoError(t, os.WriteFile(s.timeIndex.Name(), legacy, 0644))
+
+	s, err = NewSegment(dir, 16, config)
+	require.NoError(t, err)
+	defer s.Close()
+	require.Equal(t, uint64(3), s.timeIndex.entries())
+	off, ok := s.OffsetForTime(150)
+	require.True(t, ok)
+	require.Equal(t, uint64(17), off)
+}
+
+func TestLogOffsetForTime(t *testing.T) {
+	dir, err := os.MkdirTemp("", "offset-for-time-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := Config{}
+	config.Segment.MaxStoreBytes = 64
+	config.Timestamps.UseProducerTime = true
+	log, err := NewLog(dir, config)
+	require.NoError(t, err)
+
+	start := time.UnixMilli(1_700_000_000_000)
+	for i := 0; i < 6; i++ {
+		_, err := log.Append(&v1.Record{
+			Value:     []byte("hello world"),
+			Timestamp: start.Add(time.Duration(i) * time.Minute).UnixMilli(),
+		})
+		require.NoError(t, err)
+	}
+	require.Greater(t, len(log.segments), 1)
+
+	off, err := log.OffsetForTime(start.Add(-time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	off, err = log.OffsetForTime(start.Add(150 * time.Second))
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	_, err = log.OffsetForTime(start.Add(time.Hour))
+	require.Error(t, err)
+
+	// The time index survives a restart and is rebuilt when it's missing
+	require.NoError(t, log.Close())
+	require.NoError(t, os.Remove(log.segments[0].timeIndex.Name()))
+	log, err = NewLog(dir, config)
+	require.NoError(t, err)
+	off, err = log.OffsetForTime(start.Add(30 * time.Second))
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	off, err = log.OffsetForTime(start.Add(5 * time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+}
+
+func TestLogSparseTimeIndex(t *testing.T) {
+	dir, err := os.MkdirTemp("", "sparse-time-index-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := Config{}
+	config.Segment.MaxStoreBytes = 4096
+	config.Segment.MaxIndexBytes = 48
+	config.Index.IntervalRecords = 100
+	config.Timestamps.UseProducerTime = true
+	log, err := NewLog(dir, config)
+	require.NoError(t, err)
+
+	// Every record gets a time index entry, many more than the index has
+	// room for
+	const n = 20
+	start := time.UnixMilli(1_700_000_000_000)
+	for i := 0; i < n; i++ {
+		off, err := log.Append(&v1.Record{
+			Value:     []byte(fmt.Sprintf("record %d", i)),
+			Timestamp: start.Add(time.Duration(i) * time.Second).UnixMilli(),
+		})
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), off)
+	}
+	require.Len(t, log.segments, 1)
+
+	check := func(log *Log) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			record, err := log.Read(uint64(i))
+			require.NoError(t, err)
+			require.Equal(t, fmt.Sprintf("record %d", i), string(record.Value))
+			off, err := log.OffsetForTime(start.Add(time.Duration(i) * time.Second))
+			require.NoError(t, err)
+			require.Equal(t, uint64(i), off)
+		}
+	}
+	check(log)
+
+	// The entries past MaxIndexBytes survive a restart
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, config)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Equal(t, uint64(n), log.segments[0].timeIndex.entries())
+	check(log)
+}
@@ -0,0 +1,74 @@
+package log
+
+import (
+	"context"
+	"sync"
+)
+
+// watermark tracks an offset that only moves forward and lets goroutines wait
+// for it to pass the offset they are interested in
+type watermark struct {
+	mu   sync.Mutex
+	next uint64
+	err  error
+	// changed is closed and replaced every time the watermark moves
+	changed chan struct{}
+}
+
+func newWatermark(next uint64) *watermark {
+	return &watermark{
+		next:    next,
+		changed: make(chan struct{}),
+	}
+}
+
+// advance moves the watermark so every offset below next has passed it
+func (w *watermark) advance(next uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if next <= w.next {
+		return
+	}
+	w.next = next
+	close(w.changed)
+	w.changed = make(chan struct{})
+}
+
+// reset moves the watermark to next even when that's backwards, after the
+// offsets from next on were truncated
+func (w *watermark) reset(next uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.next = next
+}
+
+// fail wakes up every waiter with err, the watermark won't move after this
+func (w *watermark) fail(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return
+	}
+	w.err = err
+	close(w.changed)
+}
+
+// wait blocks until offset has passed the watermark or ctx is done
+func (w *watermark) wait(ctx context.Context, offset uint64) error {
+	for {
+		w.mu.Lock()
+		next, err, changed := w.next, w.err, w.changed
+		w.mu.Unlock()
+		if offset < next {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
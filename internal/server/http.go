@@ -3,53 +3,92 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
+	"time"
 
 	v1 "github.com/adityavit/proglog/api/v1"
 	"github.com/adityavit/proglog/internal/log"
 	"github.com/gorilla/mux"
 	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
 )
 
-func NewHTTPServer(logDir, addr string) (*http.Server, error) {
-	logConfig := log.Config{}
+func NewHTTPServer(logDir, addr string, logConfig log.Config) (*http.Server, error) {
 	log, err := log.NewLog(logDir, logConfig)
 	if err != nil {
 		return nil, err
 	}
-	httpServer := newHTTPServer(log)
 	server := &http.Server{Addr: addr}
-	router := mux.NewRouter()
-	router.HandleFunc("/", httpServer.handleProduce).Methods("POST")
-	router.HandleFunc("/", httpServer.handleConsume).Methods("GET")
-	server.Handler = router
+	server.Handler = newHTTPServer(log).handler()
 	return server, nil
 }
 
+// handler routes the requests to the handlers
+func (s *httpServer) handler() http.Handler {
+	router := mux.NewRouter()
+	router.HandleFunc("/", s.handleProduce).Methods("POST")
+	router.HandleFunc("/", s.handleConsume).Methods("GET")
+	router.HandleFunc("/offsets", s.handleOffsetForTime).Methods("GET")
+	return router
+}
+
+const (
+	// produceOverhead is room for the rest of a produce request on top of
+	// the record it holds, whose bytes fields are base64 encoded
+	produceOverhead = 64 << 10
+	// defaultMaxProduceRecordBytes bounds the records produced over HTTP
+	// when the log doesn't limit them, a produce request is read into
+	// memory whole
+	defaultMaxProduceRecordBytes = 1 << 20
+)
+
 type httpServer struct {
 	Log *log.Log
+	// maxProduceBytes bounds the body of a produce request
+	maxProduceBytes int64
 }
 
 func newHTTPServer(log *log.Log) *httpServer {
+	maxRecordBytes := log.Config.Segment.MaxRecordBytes
+	if maxRecordBytes == 0 {
+		maxRecordBytes = defaultMaxProduceRecordBytes
+	}
 	return &httpServer{
-		Log: log,
+		Log:             log,
+		maxProduceBytes: int64(maxRecordBytes/3*4 + produceOverhead),
 	}
 }
 
 // handleProduce is a handler to append a record to the log
 func (s *httpServer) handleProduce(w http.ResponseWriter, r *http.Request) {
 	var req v1.ProduceRequest
-	err := json.NewDecoder(r.Body).Decode(&req)
+	r.Body = http.MaxBytesReader(w, r.Body, s.maxProduceBytes)
+	err := decodeJSON(r, &req)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, http.StatusRequestEntityTooLarge, errorResponse{Code: codeRecordTooLarge, Message: err.Error()})
+		return
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, errorResponse{Code: codeBadRequest, Message: err.Error()})
+		return
+	}
+	if req.Record == nil {
+		writeError(w, http.StatusBadRequest, errorResponse{Code: codeBadRequest, Message: "record is required"})
 		return
 	}
 	record := &v1.Record{
-		Value: req.Record.Value,
+		Value:     req.Record.Value,
+		Key:       req.Record.Key,
+		Headers:   req.Record.Headers,
+		Timestamp: req.Record.Timestamp,
 	}
+	// Append only returns once the record reached the configured durability
 	offset, err := s.Log.Append(record)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeLogError(w, err)
 		return
 	}
 	res := v1.ProduceResponse{Offset: offset}
@@ -60,7 +99,7 @@ func (s *httpServer) handleProduce(w http.ResponseWriter, r *http.Request) {
 		EmitUnpopulated: true,
 	}.Marshal(&res)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, errorResponse{Code: codeInternal, Message: err.Error()})
 		return
 	}
 	w.Write(jsonBytes)
@@ -69,14 +108,14 @@ func (s *httpServer) handleProduce(w http.ResponseWriter, r *http.Request) {
 // handleConsume is a handler to read a record from the log
 func (s *httpServer) handleConsume(w http.ResponseWriter, r *http.Request) {
 	var req v1.ConsumeRequest
-	err := json.NewDecoder(r.Body).Decode(&req)
+	err := decodeJSON(r, &req)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, errorResponse{Code: codeBadRequest, Message: err.Error()})
 		return
 	}
 	record, err := s.Log.Read(req.Offset)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writeLogError(w, err)
 		return
 	}
 	res := v1.ConsumeResponse{Record: record}
@@ -85,8 +124,102 @@ func (s *httpServer) handleConsume(w http.ResponseWriter, r *http.Request) {
 		EmitUnpopulated: true,
 	}.Marshal(&res)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, errorResponse{Code: codeInternal, Message: err.Error()})
 		return
 	}
 	w.Write(jsonBytes)
 }
+
+// handleOffsetForTime is a handler to find the first offset at or after a timestamp
+func (s *httpServer) handleOffsetForTime(w http.ResponseWriter, r *http.Request) {
+	var req v1.OffsetForTimeRequest
+	err := decodeJSON(r, &req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errorResponse{Code: codeBadRequest, Message: err.Error()})
+		return
+	}
+	offset, err := s.Log.OffsetForTime(time.UnixMilli(req.Timestamp))
+	if err != nil {
+		writeLogError(w, err)
+		return
+	}
+	res := v1.OffsetForTimeResponse{Offset: offset}
+	w.Header().Set("Content-Type", "application/json")
+	jsonBytes, err := protojson.MarshalOptions{
+		EmitUnpopulated: true,
+	}.Marshal(&res)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errorResponse{Code: codeInternal, Message: err.Error()})
+		return
+	}
+	w.Write(jsonBytes)
+}
+
+// decodeJSON decodes the request body with protojson, so the fields are read
+// the same way responses write them e.g. 64 bit integers as strings
+func decodeJSON(r *http.Request, m proto.Message) error {
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	return protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(b, m)
+}
+
+// Error codes of the error responses, they tell clients whether to retry
+// later, carry on from another offset or give up
+const (
+	codeBadRequest       = "bad_request"
+	codeOffsetOutOfRange = "offset_out_of_range"
+	codeOffsetTruncated  = "offset_truncated"
+	codeRecordTooLarge   = "record_too_large"
+	codeSegmentFull      = "segment_full"
+	codeLogClosed        = "log_closed"
+	codeReadOnly         = "read_only"
+	codeCorruptRecord    = "corrupt_record"
+	codeInternal         = "internal"
+)
+
+// errorResponse is the body of every error response
+type errorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// LowestOffset is the offset the log starts at when the one asked for
+	// was truncated, it's a string like the offsets of the other responses
+	LowestOffset *uint64 `json:"lowestOffset,omitempty,string"`
+}
+
+// writeLogError responds with the status and code matching an error returned
+// by the log
+func writeLogError(w http.ResponseWriter, err error) {
+	res := errorResponse{Message: err.Error()}
+	var truncated *log.ErrOffsetTruncated
+	var corrupt *log.ErrCorruptRecord
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, log.ErrOffsetOutOfRange):
+		status, res.Code = http.StatusNotFound, codeOffsetOutOfRange
+	case errors.As(err, &truncated):
+		status, res.Code = http.StatusGone, codeOffsetTruncated
+		res.LowestOffset = &truncated.Start
+	case errors.Is(err, log.ErrRecordTooLarge):
+		status, res.Code = http.StatusRequestEntityTooLarge, codeRecordTooLarge
+	case errors.Is(err, log.ErrSegmentFull):
+		status, res.Code = http.StatusRequestEntityTooLarge, codeSegmentFull
+	case errors.Is(err, log.ErrLogClosed):
+		status, res.Code = http.StatusServiceUnavailable, codeLogClosed
+	case errors.Is(err, log.ErrReadOnly):
+		status, res.Code = http.StatusForbidden, codeReadOnly
+	case errors.As(err, &corrupt):
+		res.Code = codeCorruptRecord
+	default:
+		res.Code = codeInternal
+	}
+	writeError(w, status, res)
+}
+
+// writeError responds with the status and a JSON error body
+func writeError(w http.ResponseWriter, status int, res errorResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/adityavit/proglog/internal/log"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestServer opens a log in a temporary directory and returns the handler
+// of an HTTP server on it
+func newTestServer(t *testing.T, config log.Config) (http.Handler, *log.Log) {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "server-test")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	l, err := log.NewLog(dir, config)
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	return newHTTPServer(l).handler(), l
+}
+
+// do sends a request with the body to the handler and decodes the response
+// into res
+func do(t *testing.T, h http.Handler, method, target, body string, res any) int {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, target, bytes.NewBufferString(body)))
+	if res != nil {
+		require.NoError(t, json.NewDecoder(w.Body).Decode(res), w.Body.String())
+	}
+	return w.Code
+}
+
+func produceBody(value []byte) string {
+	return fmt.Sprintf(`{"record": {"value": %q}}`, base64.StdEncoding.EncodeToString(value))
+}
+
+func TestProduceBodyTooLarge(t *testing.T) {
+	h, _ := newTestServer(t, log.Config{})
+
+	// Without MaxRecordBytes the body is bounded as if it was 1MiB, not by
+	// the size of a segment
+	var errRes errorResponse
+	body := produceBody(make([]byte, 2<<20))
+	require.Equal(t, http.StatusRequestEntityTooLarge, do(t, h, "POST", "/", body, &errRes))
+	require.Equal(t, codeRecordTooLarge, errRes.Code)
+
+	var res map[string]any
+	body = produceBody(make([]byte, 1<<20))
+	require.Equal(t, http.StatusOK, do(t, h, "POST", "/", body, &res))
+	require.Equal(t, "0", res["offset"])
+}
+
+func TestWriteLogError(t *testing.T) {
+	lowest := uint64(3)
+	for _, tt := range []struct {
+		err    error
+		status int
+		code   string
+		lowest *uint64
+	}{
+		{log.ErrOffsetOutOfRange, http.StatusNotFound, codeOffsetOutOfRange, nil},
+		{&log.ErrOffsetTruncated{Offset: 1, Start: lowest}, http.StatusGone, codeOffsetTruncated, &lowest},
+		{log.ErrRecordTooLarge, http.StatusRequestEntityTooLarge, codeRecordTooLarge, nil},
+		{log.ErrSegmentFull, http.StatusRequestEntityTooLarge, codeSegmentFull, nil},
+		{log.ErrLogClosed, http.StatusServiceUnavailable, codeLogClosed, nil},
+		{log.ErrReadOnly, http.StatusForbidden, codeReadOnly, nil},
+		{&log.ErrCorruptRecord{Segment: "0.store", Reason: "checksum mismatch"}, http.StatusInternalServerError, codeCorruptRecord, nil},
+		{errors.New("disk on fire"), http.StatusInternalServerError, codeInternal, nil},
+	} {
+		t.Run(tt.code, func(t *testing.T) {
+			// The log wraps its errors with more context
+			err := fmt.Errorf("reading offset 1: %w", tt.err)
+			w := httptest.NewRecorder()
+			writeLogError(w, err)
+			require.Equal(t, tt.status, w.Code)
+			require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+			var res errorResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			require.Equal(t, errorResponse{Code: tt.code, Message: err.Error(), LowestOffset: tt.lowest}, res)
+		})
+	}
+}
+
+func TestHandlers(t *testing.T) {
+	config := log.Config{}
+	config.Timestamps.UseProducerTime = true
+	h, l := newTestServer(t, config)
+	for i := 0; i < 3; i++ {
+		var res map[string]any
+		body := fmt.Sprintf(`{"record": {"value": "cmVjb3Jk", "timestamp": "%d"}}`, (i+1)*1000)
+		require.Equal(t, http.StatusOK, do(t, h, "POST", "/", body, &res))
+		require.Equal(t, fmt.Sprint(i), res["offset"])
+	}
+
+	var res map[string]any
+	require.Equal(t, http.StatusOK, do(t, h, "GET", "/", `{"offset": "1"}`, &res))
+	require.Equal(t, "1", res["record"].(map[string]any)["offset"])
+	require.Equal(t, "cmVjb3Jk", res["record"].(map[string]any)["value"])
+	require.Equal(t, http.StatusOK, do(t, h, "GET", "/offsets", `{"timestamp": "1500"}`, &res))
+	require.Equal(t, "1", res["offset"])
+
+	var errRes errorResponse
+	require.Equal(t, http.StatusNotFound, do(t, h, "GET", "/", `{"offset": "3"}`, &errRes))
+	require.Equal(t, codeOffsetOutOfRange, errRes.Code)
+	require.Equal(t, http.StatusNotFound, do(t, h, "GET", "/offsets", `{"timestamp": "4000"}`, &errRes))
+	require.Equal(t, codeOffsetOutOfRange, errRes.Code)
+	for _, req := range []struct{ method, target, body string }{
+		{"POST", "/", `{"record":`},
+		{"POST", "/", `{}`},
+		{"GET", "/", `{"offset": -1}`},
+		{"GET", "/offsets", `[]`},
+	} {
+		errRes = errorResponse{}
+		require.Equal(t, http.StatusBadRequest, do(t, h, req.method, req.target, req.body, &errRes), req)
+		require.Equal(t, codeBadRequest, errRes.Code, req)
+	}
+
+	// Reads below the start of the log tell clients where to carry on from
+	require.NoError(t, l.Truncate(2))
+	errRes = errorResponse{}
+	require.Equal(t, http.StatusGone, do(t, h, "GET", "/", `{"offset": "0"}`, &errRes))
+	require.Equal(t, codeOffsetTruncated, errRes.Code)
+	require.NotNil(t, errRes.LowestOffset)
+	require.Equal(t, uint64(2), *errRes.LowestOffset)
+	require.Equal(t, http.StatusOK, do(t, h, "GET", "/offsets", `{"timestamp": "0"}`, &res))
+	require.Equal(t, "2", res["offset"])
+
+	// A read-only server on the same log refuses produce requests
+	config.ReadOnly.Enabled = true
+	ro, err := log.NewLog(l.Dir, config)
+	require.NoError(t, err)
+	defer ro.Close()
+	roHandler := newHTTPServer(ro).handler()
+	errRes = errorResponse{}
+	require.Equal(t, http.StatusForbidden, do(t, roHandler, "POST", "/", produceBody([]byte("record")), &errRes))
+	require.Equal(t, codeReadOnly, errRes.Code)
+
+	require.NoError(t, l.Close())
+	errRes = errorResponse{}
+	require.Equal(t, http.StatusServiceUnavailable, do(t, h, "GET", "/", `{"offset": "2"}`, &errRes))
+	require.Equal(t, codeLogClosed, errRes.Code)
+}
+
+func TestProduceRecordTooLarge(t *testing.T) {
+	config := log.Config{}
+	config.Segment.MaxRecordBytes = 16
+	h, _ := newTestServer(t, config)
+
+	// The body fits, the record doesn't
+	var errRes errorResponse
+	require.Equal(t, http.StatusRequestEntityTooLarge, do(t, h, "POST", "/", produceBody(make([]byte, 32)), &errRes))
+	require.Equal(t, codeRecordTooLarge, errRes.Code)
+}
@@ -1,10 +1,10 @@
 package server
 
 import (
-	"errors"
 	"sync"
 
 	v1 "github.com/adityavit/proglog/api/v1"
+	"github.com/adityavit/proglog/internal/log"
 )
 
 type Log struct {
@@ -12,7 +12,9 @@ type Log struct {
 	records []*v1.Record
 }
 
-var ErrOffsetNotFound = errors.New("offset not found")
+// ErrOffsetNotFound is the error the log package returns for offsets past the
+// end of the log, so both logs can be handled the same way
+var ErrOffsetNotFound = log.ErrOffsetOutOfRange
 
 func NewLog() *Log {
 	return &Log{}